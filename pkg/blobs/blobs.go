@@ -0,0 +1,59 @@
+package blobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobStore stores immutable blobs under content-addressed keys, as returned by Key. Storing
+// the same key twice is allowed and refreshes the blob's modification time, so that garbage
+// collection doesn't remove a blob that was just reused.
+type BlobStore interface {
+	Put(key string, data []byte) error
+
+	// Get returns ErrNotFound if there is no blob with the key.
+	Get(key string) ([]byte, error)
+
+	// Stat describes a blob without reading it, or returns ErrNotFound.
+	Stat(key string) (*BlobInfo, error)
+
+	// Delete removes a blob. Deleting a missing blob is not an error.
+	Delete(key string) error
+
+	// List calls fn for every blob in the store, stopping at the first error fn returns.
+	List(fn func(info *BlobInfo) error) error
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key        string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// Key returns the content-addressed key for data, its hex-encoded SHA-256 hash.
+func Key(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidKey reports whether key could have been returned by Key. Stores reject other keys, so
+// that they can't be used to escape the store's directory or prefix.
+func ValidKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range key {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
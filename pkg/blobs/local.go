@@ -0,0 +1,120 @@
+package blobs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LocalStore keeps blobs as files in a directory, sharded into subdirectories by the first two
+// characters of their key.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates a LocalStore in root, creating the directory if needed.
+func NewLocalStore(root string) (*LocalStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.root, key[:2], key)
+}
+
+func (s *LocalStore) Put(key string, data []byte) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	path := s.path(key)
+
+	// The key is derived from the content, so an existing blob already holds the same data.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a partial blob behind.
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Get(key string) ([]byte, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *LocalStore) Stat(key string) (*BlobInfo, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	info, err := os.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{Key: key, Size: info.Size(), ModifiedAt: info.ModTime()}, nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) List(fn func(info *BlobInfo) error) error {
+	return filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skips directories and leftover temporary files.
+		if entry.IsDir() || !ValidKey(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return fn(&BlobInfo{Key: entry.Name(), Size: info.Size(), ModifiedAt: info.ModTime()})
+	})
+}
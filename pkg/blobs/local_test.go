@@ -0,0 +1,95 @@
+package blobs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("save data")
+	key := Key(data)
+
+	if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get before Put = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Stat(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat before Put = %v, want ErrNotFound", err)
+	}
+	if err := store.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(key); err != nil || string(got) != string(data) {
+		t.Errorf("Get = %q, %v, want %q", got, err, data)
+	}
+
+	// Storing the same blob again refreshes it, so that it isn't collected.
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(store.path(key), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || time.Since(info.ModifiedAt) > time.Minute {
+		t.Errorf("Stat after storing again = %+v", info)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+	if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+	}
+	if err := store.Put("../escape", data); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put with an invalid key = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{}
+	for _, data := range []string{"one", "two", "three"} {
+		if err := store.Put(Key([]byte(data)), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		want[Key([]byte(data))] = true
+	}
+	// Leftover temporary files are skipped.
+	if err := os.WriteFile(filepath.Join(root, ".tmp-123"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	if err := store.List(func(info *BlobInfo) error {
+		got[info.Key] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	for key := range want {
+		if !got[key] {
+			t.Errorf("%s wasn't listed", key)
+		}
+	}
+}
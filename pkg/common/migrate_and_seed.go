@@ -1,11 +1,18 @@
 package common
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/storage/pkg/identities"
+	"github.com/cloudlink-omega/storage/pkg/mfa"
 	"github.com/cloudlink-omega/storage/pkg/old_types"
+	"github.com/cloudlink-omega/storage/pkg/passwords"
+	"github.com/cloudlink-omega/storage/pkg/saves"
 	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/cloudlink-omega/storage/pkg/users"
+	"github.com/cloudlink-omega/storage/pkg/verification"
 	"github.com/gofiber/fiber/v2/log"
 	"gorm.io/gorm"
 )
@@ -16,19 +23,42 @@ func MigrateAndSeed(db *gorm.DB) error {
 		panic("Got nil database")
 	}
 
+	// Rebuild tables that AutoMigrate can't upgrade in place
+	if err := mfa.MigrateLegacyTOTP(db); err != nil {
+		return err
+	}
+	if err := mfa.MigrateLegacyRecoveryCodes(db); err != nil {
+		return err
+	}
+	if err := verification.MigrateLegacyVerifications(db); err != nil {
+		return err
+	}
+	if err := saves.MigrateLegacySaves(db); err != nil {
+		return err
+	}
+
+	// Shorten legacy usernames to fit their new column size
+	if err := users.MigrateUserFieldLengths(db); err != nil {
+		return err
+	}
+
 	// Perform database migrations
 	if err := db.AutoMigrate(
 		&types.Event{},
 		&types.ReportTag{},
 		&types.SystemEvent{},
 		&types.User{},
+		&types.UserPassword{},
 		&types.Verification{},
+		&types.PendingEmailChange{},
 		&types.RecoveryCode{},
-		&types.UserGoogle{},
-		&types.UserDiscord{},
-		&types.UserGitHub{},
+		&types.IdentityProvider{},
+		&types.UserIdentity{},
 		&types.UserTOTP{},
+		&types.UserWebAuthnCredential{},
 		&types.UserSession{},
+		&types.UserDevice{},
+		&types.LoginLockout{},
 		&types.UserEvent{},
 		&types.UserReport{},
 		&types.Developer{},
@@ -40,12 +70,31 @@ func MigrateAndSeed(db *gorm.DB) error {
 		&types.GameComment{},
 		&types.Achievement{},
 		&types.UserGameSave{},
+		&types.UserGameSaveRevision{},
 		&types.Image{},
 		&types.FeatureTag{},
 	); err != nil {
 		return err
 	}
 
+	// Create password records for hashes that predate them
+	if err := passwords.MigrateLegacyPasswords(db); err != nil {
+		return err
+	}
+
+	// Move links from the old per-provider tables into user identities
+	if err := identities.MigrateLegacyProviders(db); err != nil {
+		return err
+	}
+
+	// Make room for the slots of old saves, and count them towards quotas
+	if err := saves.MigrateSaveSlotLimits(db); err != nil {
+		return err
+	}
+	if err := saves.MigrateStoredSizes(db); err != nil {
+		return err
+	}
+
 	// Seed all feature tags
 	for key, entry := range types.GameFeatureTags {
 		tag := &types.FeatureTag{
@@ -201,6 +250,12 @@ func ConvertDatabase(old_db *gorm.DB, new_db *gorm.DB, accounts_db *database.Dat
 			State:     user.State,
 			CreatedAt: time.Unix(user.Created, 0),
 		}
+
+		// Legacy usernames could be longer, but must otherwise follow the current rules
+		new_user.Username = users.FitUsername(new_user.Username, new_user.ID)
+		if err := new_user.Validate(); err != nil {
+			return fmt.Errorf("legacy user %s: %w", user.ID, err)
+		}
 		if err := new_db.FirstOrCreate(&new_user).Error; err != nil {
 			return err
 		}
@@ -216,8 +271,19 @@ func ConvertDatabase(old_db *gorm.DB, new_db *gorm.DB, accounts_db *database.Dat
 
 			log.Debug(" > ", save.GameID, " (", save.SlotID, ")...")
 
-			// Encrypt the save
-			encrypted_save, err := accounts_db.Encrypt(new_user, save.Contents)
+			// Make room for legacy slots beyond the default
+			if err := new_db.Model(&types.DeveloperGame{}).
+				Where("id = ? AND max_save_slots < ?", save.GameID, save.SlotID).
+				Update("max_save_slots", save.SlotID).Error; err != nil {
+				return err
+			}
+
+			// Compress and encrypt the save
+			encoded_save, codec, err := saves.EncodeSaveData(save.Contents, saves.DefaultCodec)
+			if err != nil {
+				return err
+			}
+			encrypted_save, err := accounts_db.Encrypt(new_user, encoded_save)
 			if err != nil {
 				return err
 			}
@@ -228,12 +294,18 @@ func ConvertDatabase(old_db *gorm.DB, new_db *gorm.DB, accounts_db *database.Dat
 				DeveloperGameID: save.GameID,
 				SaveSlot:        save.SlotID,
 				SaveData:        encrypted_save,
+				Size:            uint32(len(save.Contents)),
+				StoredSize:      uint32(len(encrypted_save)),
+				Codec:           codec,
 			}
 			if err := new_db.Save(&new_save).Error; err != nil {
 				return err
 			}
 		}
 	}
+	if err := passwords.MigrateLegacyPasswords(new_db); err != nil {
+		return err
+	}
 	log.Info("Done converting users and saves.")
 	time.Sleep(3 * time.Second)
 
@@ -0,0 +1,208 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// KeySize is the size of master keys and data keys, selecting AES-256.
+const KeySize = 32
+
+// version prefixes every sealed value, so that the format can change later.
+const version = "v2"
+
+var (
+	ErrUnknownKey   = errors.New("unknown master key")
+	ErrInvalidKey   = errors.New("master keys must be 32 bytes")
+	ErrMalformed    = errors.New("malformed envelope")
+	ErrNoCurrentKey = errors.New("no current master key")
+)
+
+// Keyring holds the master keys used to wrap data keys. New values are always sealed with the
+// current key, while older keys are kept so that existing values can still be opened and
+// re-wrapped during a rotation.
+type Keyring struct {
+	lock    sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string][]byte{}}
+}
+
+// Add registers a master key under the given ID. If current is set, it becomes the key used
+// for new values.
+func (k *Keyring) Add(id string, key []byte, current bool) error {
+	if len(key) != KeySize {
+		return ErrInvalidKey
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	if current {
+		k.current = id
+	}
+	return nil
+}
+
+// Current returns the ID of the key used for new values.
+func (k *Keyring) Current() string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current
+}
+
+func (k *Keyring) key(id string) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext under a fresh data key and wraps the data key with the current
+// master key. It returns the sealed value along with the ID of the master key used.
+// The value is bound to aad, typically the ID of the row and the name of the column it is
+// stored in, and to the master key ID, so that it only opens with the same aad and key ID.
+func (k *Keyring) Seal(plaintext []byte, aad []byte) (string, string, error) {
+	keyID := k.Current()
+	if keyID == "" {
+		return "", "", ErrNoCurrentKey
+	}
+	master, err := k.key(keyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", "", err
+	}
+	wrapped, err := seal(master, dataKey, []byte(keyID))
+	if err != nil {
+		return "", "", err
+	}
+	data, err := seal(dataKey, plaintext, aad)
+	if err != nil {
+		return "", "", err
+	}
+	return encode(wrapped, data), keyID, nil
+}
+
+// Open decrypts a value sealed under the master key with the given ID and the given aad.
+func (k *Keyring) Open(sealed string, keyID string, aad []byte) ([]byte, error) {
+	dataKey, data, err := k.unwrap(sealed, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, data, aad)
+}
+
+// Rewrap re-encrypts the data key of a sealed value under the current master key. The data
+// itself is not touched, so aad is only checked: a value that doesn't open with it is refused.
+// It returns the new value and the ID of the current key.
+func (k *Keyring) Rewrap(sealed string, keyID string, aad []byte) (string, string, error) {
+	dataKey, data, err := k.unwrap(sealed, keyID)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := open(dataKey, data, aad); err != nil {
+		return "", "", err
+	}
+
+	currentID := k.Current()
+	if currentID == "" {
+		return "", "", ErrNoCurrentKey
+	}
+	current, err := k.key(currentID)
+	if err != nil {
+		return "", "", err
+	}
+	rewrapped, err := seal(current, dataKey, []byte(currentID))
+	if err != nil {
+		return "", "", err
+	}
+	return encode(rewrapped, data), currentID, nil
+}
+
+// unwrap decodes a sealed value and decrypts its data key with the master key with the given
+// ID.
+func (k *Keyring) unwrap(sealed string, keyID string) (dataKey []byte, data []byte, err error) {
+	wrapped, data, err := decode(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	master, err := k.key(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dataKey, err = open(master, wrapped, []byte(keyID)); err != nil {
+		return nil, nil, err
+	}
+	return dataKey, data, nil
+}
+
+// seal encrypts plaintext with AES-GCM and prepends the nonce.
+func seal(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+// encode joins the wrapped data key and the encrypted data as "v2.<key>.<data>".
+func encode(wrapped []byte, data []byte) string {
+	return strings.Join([]string{
+		version,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(data),
+	}, ".")
+}
+
+// decode splits a sealed value into the wrapped data key and the encrypted data.
+func decode(sealed string) (wrapped []byte, data []byte, err error) {
+	parts := strings.Split(sealed, ".")
+	if len(parts) != 3 || parts[0] != version {
+		return nil, nil, ErrMalformed
+	}
+	if wrapped, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, nil, ErrMalformed
+	}
+	if data, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return nil, nil, ErrMalformed
+	}
+	return wrapped, data, nil
+}
@@ -0,0 +1,124 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	k := NewKeyring()
+	for _, id := range ids {
+		key := make([]byte, KeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.Add(id, key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return k
+}
+
+func TestSealOpen(t *testing.T) {
+	k := newTestKeyring(t, "old", "new")
+	plaintext := []byte("refresh token")
+	aad := []byte("identity/refresh_token_enc")
+
+	sealed, keyID, err := k.Seal(plaintext, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "new" {
+		t.Fatalf("sealed with key %q, want the current key", keyID)
+	}
+
+	tests := []struct {
+		name   string
+		sealed string
+		keyID  string
+		aad    []byte
+		ok     bool
+	}{
+		{"same aad and key", sealed, keyID, aad, true},
+		{"other aad", sealed, keyID, []byte("other/refresh_token_enc"), false},
+		{"no aad", sealed, keyID, nil, false},
+		{"other key ID", sealed, "old", aad, false},
+		{"unknown key ID", sealed, "missing", aad, false},
+		{"truncated", sealed[:len(sealed)-4], keyID, aad, false},
+		{"malformed", "v2.abc", keyID, aad, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opened, err := k.Open(test.sealed, test.keyID, test.aad)
+			if test.ok {
+				if err != nil || !bytes.Equal(opened, plaintext) {
+					t.Errorf("Open = %q, %v, want %q", opened, err, plaintext)
+				}
+			} else if err == nil {
+				t.Errorf("Open succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	k := newTestKeyring(t, "old")
+	aad := []byte("identity/access_token_enc")
+	sealed, _, err := k.Seal([]byte("access token"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestKey := make([]byte, KeySize)
+	if err := k.Add("new", newTestKey, true); err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, keyID, err := k.Rewrap(sealed, "old", aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "new" {
+		t.Errorf("rewrapped under %q, want the current key", keyID)
+	}
+	// The data itself is left alone.
+	if strings.Split(rewrapped, ".")[2] != strings.Split(sealed, ".")[2] {
+		t.Error("Rewrap re-encrypted the data")
+	}
+	if opened, err := k.Open(rewrapped, keyID, aad); err != nil || string(opened) != "access token" {
+		t.Errorf("Open after Rewrap = %q, %v", opened, err)
+	}
+	if _, err := k.Open(rewrapped, "old", aad); err == nil {
+		t.Error("Open with the old key ID succeeded after Rewrap")
+	}
+	if _, _, err := k.Rewrap(rewrapped, keyID, []byte("other")); err == nil {
+		t.Error("Rewrap with other aad succeeded")
+	}
+}
+
+func TestRejectsOtherVersions(t *testing.T) {
+	k := newTestKeyring(t, "key")
+	aad := []byte("identity/access_token_enc")
+	sealed, _, err := k.Seal([]byte("access token"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v1 values were sealed without additional data and are no longer accepted.
+	v1 := "v1" + strings.TrimPrefix(sealed, version)
+	if _, err := k.Open(v1, "key", aad); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Open of a v1 value = %v, want ErrMalformed", err)
+	}
+	if _, _, err := k.Rewrap(v1, "key", aad); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Rewrap of a v1 value = %v, want ErrMalformed", err)
+	}
+}
+
+func TestAddRejectsShortKeys(t *testing.T) {
+	if err := NewKeyring().Add("short", make([]byte, 16), true); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Add = %v, want ErrInvalidKey", err)
+	}
+}
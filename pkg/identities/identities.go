@@ -0,0 +1,124 @@
+package identities
+
+import (
+	"errors"
+
+	"github.com/cloudlink-omega/storage/pkg/envelope"
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ProviderGoogle  = "google"
+	ProviderDiscord = "discord"
+	ProviderGitHub  = "github"
+)
+
+var (
+	ErrNotFound        = errors.New("identity not found")
+	ErrAlreadyLinked   = errors.New("identity is already linked to a user")
+	ErrLastLoginMethod = errors.New("cannot unlink the last login method")
+)
+
+// IdentityRepository links users to accounts on external login providers.
+type IdentityRepository struct {
+	db      *gorm.DB
+	keyring *envelope.Keyring
+}
+
+func NewIdentityRepository(db *gorm.DB) *IdentityRepository {
+	if db == nil {
+		panic("Got nil database")
+	}
+	return &IdentityRepository{db: db}
+}
+
+// Link stores a new identity for identity.UserID. If the provider account is already linked,
+// ErrAlreadyLinked is returned, even if it belongs to the same user. Identities of built-in
+// providers are keyed by the provider's name if they have no Issuer.
+func (r *IdentityRepository) Link(identity *types.UserIdentity) error {
+	if identity.ID == "" {
+		identity.ID = ulid.Make().String()
+	}
+	if identity.Issuer == "" {
+		identity.Issuer = identity.Provider
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&types.UserIdentity{}).
+			Where("issuer = ? AND provider_user_id = ?", identity.Issuer, identity.ProviderUserID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyLinked
+		}
+		if err := tx.Create(identity).Error; err != nil {
+			if dbutil.IsUniqueViolation(err) {
+				return ErrAlreadyLinked
+			}
+			return err
+		}
+		return dbutil.LogUserEvent(tx, identity.UserID, "user_identity_linked", identity.Provider, true)
+	})
+}
+
+// Lookup returns the identity for the given provider account.
+func (r *IdentityRepository) Lookup(provider string, providerUserID string) (*types.UserIdentity, error) {
+	identity := &types.UserIdentity{}
+	if err := r.db.Where("provider = ? AND provider_user_id = ?", provider, providerUserID).First(identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return identity, nil
+}
+
+// ListForUser returns every identity linked to the user.
+func (r *IdentityRepository) ListForUser(userID string) ([]*types.UserIdentity, error) {
+	var identities []*types.UserIdentity
+	if err := r.db.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// Unlink removes an identity from the user. It refuses with ErrLastLoginMethod if the user
+// would be left without any way to log in.
+func (r *IdentityRepository) Unlink(userID string, provider string, providerUserID string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the user serializes the removal of login methods, so that concurrent ones
+		// can't each see another method left and together remove them all.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userID).First(&types.User{}).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		identity := &types.UserIdentity{}
+		if err := tx.Where("user_id = ? AND provider = ? AND provider_user_id = ?", userID, provider, providerUserID).First(identity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		methods, err := dbutil.CountLoginMethods(tx, userID)
+		if err != nil {
+			return err
+		}
+		if methods <= 1 {
+			return ErrLastLoginMethod
+		}
+
+		if err := tx.Delete(identity).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_identity_unlinked", identity.Provider, true)
+	})
+}
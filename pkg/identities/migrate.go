@@ -0,0 +1,80 @@
+package identities
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+type legacyLink struct {
+	ID        string
+	UserID    string
+	CreatedAt time.Time
+}
+
+// MigrateLegacyProviders moves the rows of the old per-provider tables (UserGoogle,
+// UserDiscord and UserGitHub) into UserIdentity. Each table is moved in a single transaction,
+// and it is safe to run on every startup. The emptied tables are left in place.
+func MigrateLegacyProviders(db *gorm.DB) error {
+	legacy := []struct {
+		provider string
+		model    any
+	}{
+		{ProviderGoogle, &types.UserGoogle{}},
+		{ProviderDiscord, &types.UserDiscord{}},
+		{ProviderGitHub, &types.UserGitHub{}},
+	}
+
+	for _, entry := range legacy {
+		if !db.Migrator().HasTable(entry.model) {
+			continue
+		}
+
+		var links []*legacyLink
+		if err := db.Model(entry.model).Find(&links).Error; err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			continue
+		}
+
+		var migrated int
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			for _, link := range links {
+				var count int64
+				if err := tx.Model(&types.UserIdentity{}).
+					Where("provider = ? AND provider_user_id = ?", entry.provider, link.ID).
+					Count(&count).Error; err != nil {
+					return err
+				}
+				if count == 0 {
+					if err := tx.Create(&types.UserIdentity{
+						ID:             ulid.Make().String(),
+						Provider:       entry.provider,
+						Issuer:         entry.provider,
+						ProviderUserID: link.ID,
+						UserID:         link.UserID,
+						CreatedAt:      link.CreatedAt,
+					}).Error; err != nil {
+						return err
+					}
+				}
+				if err := tx.Where("id = ?", link.ID).Delete(entry.model).Error; err != nil {
+					return err
+				}
+				migrated++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if migrated > 0 {
+			log.Info("Migrated ", migrated, " ", entry.provider, " links into user identities.")
+		}
+	}
+	return nil
+}
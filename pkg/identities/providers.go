@@ -0,0 +1,182 @@
+package identities
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// DefaultOIDCScopes are used when a provider is registered without any scopes.
+const DefaultOIDCScopes = "openid email profile"
+
+var (
+	ErrProviderNotFound = errors.New("identity provider not found")
+	ErrProviderDisabled = errors.New("identity provider is disabled")
+	ErrProviderExists   = errors.New("identity provider already exists")
+	ErrInvalidIssuer    = errors.New("issuer must be an absolute https URL")
+)
+
+// NormalizeIssuer trims trailing slashes from an issuer URL, so that "https://a/" and
+// "https://a" resolve to the same provider. Plain http is only allowed for localhost.
+func NormalizeIssuer(issuer string) (string, error) {
+	issuer = strings.TrimRight(strings.TrimSpace(issuer), "/")
+	parsed, err := url.Parse(issuer)
+	if err != nil || parsed.Host == "" {
+		return "", ErrInvalidIssuer
+	}
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && parsed.Hostname() == "localhost") {
+		return "", ErrInvalidIssuer
+	}
+	return issuer, nil
+}
+
+// RegisterProvider stores a new provider configuration. New OIDC providers such as GitLab,
+// Microsoft or a self-hosted Keycloak only need a row here, not a schema change. It fails with
+// ErrProviderExists if the ID or issuer URL is already taken.
+func (r *IdentityRepository) RegisterProvider(provider *types.IdentityProvider) error {
+	if err := normalizeProvider(provider); err != nil {
+		return err
+	}
+	if provider.Scopes == "" {
+		provider.Scopes = DefaultOIDCScopes
+	}
+	if err := r.db.Create(provider).Error; err != nil {
+		if dbutil.IsUniqueViolation(err) {
+			return ErrProviderExists
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateProvider saves changes to an existing provider configuration. If its issuer URL
+// changes, the identities linked through it are moved to the new issuer. It fails with
+// ErrProviderExists if another provider already has the issuer URL.
+func (r *IdentityRepository) UpdateProvider(provider *types.IdentityProvider) error {
+	if err := normalizeProvider(provider); err != nil {
+		return err
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(provider).Select("*").Omit("CreatedAt").Updates(provider)
+		if result.Error != nil {
+			if dbutil.IsUniqueViolation(result.Error) {
+				return ErrProviderExists
+			}
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrProviderNotFound
+		}
+		return tx.Model(&types.UserIdentity{}).
+			Where("provider = ? AND issuer <> ?", provider.ID, issuerOf(provider)).
+			Update("issuer", issuerOf(provider)).Error
+	})
+}
+
+// normalizeProvider normalizes the issuer URL of a provider, treating an empty one as none.
+func normalizeProvider(provider *types.IdentityProvider) error {
+	if provider.IssuerURL == nil || *provider.IssuerURL == "" {
+		provider.IssuerURL = nil
+		return nil
+	}
+	issuer, err := NormalizeIssuer(*provider.IssuerURL)
+	if err != nil {
+		return err
+	}
+	provider.IssuerURL = &issuer
+	return nil
+}
+
+// issuerOf returns the issuer that identities linked through a provider are keyed by: the
+// issuer URL for OIDC providers, and the provider's name for built-in ones.
+func issuerOf(provider *types.IdentityProvider) string {
+	if provider.IssuerURL != nil {
+		return *provider.IssuerURL
+	}
+	return provider.ID
+}
+
+// GetProvider returns the provider with the given ID.
+func (r *IdentityRepository) GetProvider(id string) (*types.IdentityProvider, error) {
+	provider := &types.IdentityProvider{}
+	if err := r.db.Where("id = ?", id).First(provider).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProviderNotFound
+		}
+		return nil, err
+	}
+	return provider, nil
+}
+
+// GetProviderByIssuer returns the OIDC provider with the given issuer URL.
+func (r *IdentityRepository) GetProviderByIssuer(issuer string) (*types.IdentityProvider, error) {
+	issuer, err := NormalizeIssuer(issuer)
+	if err != nil {
+		return nil, err
+	}
+	provider := &types.IdentityProvider{}
+	if err := r.db.Where("issuer_url = ?", issuer).First(provider).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProviderNotFound
+		}
+		return nil, err
+	}
+	return provider, nil
+}
+
+// ListProviders returns the configured providers. If enabledOnly is set, disabled ones are left out.
+func (r *IdentityRepository) ListProviders(enabledOnly bool) ([]*types.IdentityProvider, error) {
+	query := r.db.Order("id")
+	if enabledOnly {
+		query = query.Where("enabled = ?", true)
+	}
+	var providers []*types.IdentityProvider
+	if err := query.Find(&providers).Error; err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+// LinkOIDC links the account identified by an OIDC issuer and subject to the user.
+func (r *IdentityRepository) LinkOIDC(userID string, issuer string, subject string, email string, displayName string) (*types.UserIdentity, error) {
+	provider, err := r.GetProviderByIssuer(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !provider.Enabled {
+		return nil, ErrProviderDisabled
+	}
+
+	identity := &types.UserIdentity{
+		Provider:       provider.ID,
+		Issuer:         issuerOf(provider),
+		ProviderUserID: subject,
+		UserID:         userID,
+		Email:          email,
+		DisplayName:    displayName,
+	}
+	if err := r.Link(identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// LookupOIDC returns the identity for an OIDC issuer and subject.
+func (r *IdentityRepository) LookupOIDC(issuer string, subject string) (*types.UserIdentity, error) {
+	issuer, err := NormalizeIssuer(issuer)
+	if err != nil {
+		return nil, err
+	}
+	identity := &types.UserIdentity{}
+	if err := r.db.Where("issuer = ? AND provider_user_id = ?", issuer, subject).First(identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return identity, nil
+}
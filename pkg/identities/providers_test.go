@@ -0,0 +1,142 @@
+package identities
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func newTestRepository(t *testing.T) *IdentityRepository {
+	db := dbtest.Open(t, &types.User{}, &types.IdentityProvider{}, &types.UserIdentity{}, &types.UserEvent{})
+	return NewIdentityRepository(db)
+}
+
+func TestRegisterProviderKeepsEnabled(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		r := newTestRepository(t)
+		if err := r.RegisterProvider(&types.IdentityProvider{ID: "gitlab", DisplayName: "GitLab", ClientID: "client", Enabled: enabled}); err != nil {
+			t.Fatal(err)
+		}
+		provider, err := r.GetProvider("gitlab")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if provider.Enabled != enabled {
+			t.Errorf("registered with Enabled %v, stored as %v", enabled, provider.Enabled)
+		}
+	}
+}
+
+func registerOIDC(t *testing.T, r *IdentityRepository, id string, issuer string) *types.IdentityProvider {
+	t.Helper()
+	provider := &types.IdentityProvider{ID: id, DisplayName: id, IssuerURL: &issuer, ClientID: "client", Enabled: true}
+	if err := r.RegisterProvider(provider); err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestProviderIssuersAreUnique(t *testing.T) {
+	r := newTestRepository(t)
+
+	// Built-in providers have no issuer, and any number of them can coexist.
+	for _, id := range []string{ProviderGoogle, ProviderDiscord, ProviderGitHub} {
+		if err := r.RegisterProvider(&types.IdentityProvider{ID: id, DisplayName: id, ClientID: "client", Enabled: true}); err != nil {
+			t.Fatalf("registering %s: %v", id, err)
+		}
+	}
+
+	registerOIDC(t, r, "gitlab", "https://gitlab.com")
+	keycloak := registerOIDC(t, r, "keycloak", "https://sso.example.com/realms/main")
+
+	issuer := "https://gitlab.com/"
+	if err := r.RegisterProvider(&types.IdentityProvider{ID: "gitlab2", DisplayName: "GitLab", IssuerURL: &issuer, ClientID: "client"}); !errors.Is(err, ErrProviderExists) {
+		t.Errorf("registering a taken issuer = %v, want ErrProviderExists", err)
+	}
+	keycloak.IssuerURL = &issuer
+	if err := r.UpdateProvider(keycloak); !errors.Is(err, ErrProviderExists) {
+		t.Errorf("updating to a taken issuer = %v, want ErrProviderExists", err)
+	}
+}
+
+func TestIdentitiesFollowIssuerChanges(t *testing.T) {
+	r := newTestRepository(t)
+	provider := registerOIDC(t, r, "keycloak", "https://old.example.com")
+	if _, err := r.LinkOIDC("user", "https://old.example.com", "subject", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same subject at another issuer is a different account.
+	registerOIDC(t, r, "other", "https://other.example.com")
+	if _, err := r.LinkOIDC("user2", "https://other.example.com", "subject", "", ""); err != nil {
+		t.Errorf("linking the same subject at another issuer: %v", err)
+	}
+	if _, err := r.LinkOIDC("user2", "https://old.example.com", "subject", "", ""); !errors.Is(err, ErrAlreadyLinked) {
+		t.Errorf("linking a linked account = %v, want ErrAlreadyLinked", err)
+	}
+
+	issuer := "https://new.example.com"
+	provider.IssuerURL = &issuer
+	if err := r.UpdateProvider(provider); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := r.LookupOIDC("https://new.example.com/", "subject")
+	if err != nil {
+		t.Fatalf("looking up by the new issuer: %v", err)
+	}
+	if identity.UserID != "user" || identity.Issuer != issuer {
+		t.Errorf("identity = %+v, want user's identity at %s", identity, issuer)
+	}
+	if _, err := r.LookupOIDC("https://old.example.com", "subject"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("looking up by the old issuer = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMigrateLegacyProviders(t *testing.T) {
+	r := newTestRepository(t)
+	if err := r.db.AutoMigrate(&types.UserGoogle{}, &types.UserDiscord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Create(&[]*types.UserGoogle{{ID: "g1", UserID: "alice"}, {ID: "g2", UserID: "bob"}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Create(&types.UserDiscord{ID: "d1", UserID: "alice"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A link that was already moved, e.g. by a run that stopped before deleting it.
+	if err := r.db.Create(&types.UserIdentity{ID: "existing", Provider: ProviderGoogle, Issuer: ProviderGoogle, ProviderUserID: "g1", UserID: "alice"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := MigrateLegacyProviders(r.db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var identities []*types.UserIdentity
+	if err := r.db.Order("provider, provider_user_id").Find(&identities).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ provider, subject, userID string }{
+		{ProviderDiscord, "d1", "alice"},
+		{ProviderGoogle, "g1", "alice"},
+		{ProviderGoogle, "g2", "bob"},
+	}
+	if len(identities) != len(want) {
+		t.Fatalf("migrated %d identities, want %d", len(identities), len(want))
+	}
+	for i, identity := range identities {
+		w := want[i]
+		if identity.Provider != w.provider || identity.Issuer != w.provider || identity.ProviderUserID != w.subject || identity.UserID != w.userID {
+			t.Errorf("identity %d = %+v, want %+v", i, identity, w)
+		}
+	}
+
+	var count int64
+	if err := r.db.Model(&types.UserGoogle{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("%d Google links left, %v, want 0", count, err)
+	}
+}
@@ -0,0 +1,150 @@
+package identities
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/envelope"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+)
+
+// rotationBatchSize is how many identities are re-wrapped per transaction during a rotation.
+const rotationBatchSize = 100
+
+var ErrNoKeyring = errors.New("no keyring configured for token encryption")
+
+// SetKeyring sets the keyring used to encrypt provider tokens.
+func (r *IdentityRepository) SetKeyring(keyring *envelope.Keyring) {
+	r.keyring = keyring
+}
+
+// SetTokens encrypts and stores the provider's access and refresh tokens for an identity.
+// An empty refresh token clears the stored one.
+func (r *IdentityRepository) SetTokens(identityID string, accessToken string, refreshToken string, expiresAt *time.Time) error {
+	if r.keyring == nil {
+		return ErrNoKeyring
+	}
+
+	access, keyID, err := r.keyring.Seal([]byte(accessToken), tokenAAD(identityID, "access_token_enc"))
+	if err != nil {
+		return err
+	}
+	var refresh string
+	if refreshToken != "" {
+		if refresh, _, err = r.keyring.Seal([]byte(refreshToken), tokenAAD(identityID, "refresh_token_enc")); err != nil {
+			return err
+		}
+	}
+
+	result := r.db.Model(&types.UserIdentity{}).Where("id = ?", identityID).Updates(map[string]any{
+		"access_token_enc":  access,
+		"refresh_token_enc": refresh,
+		"token_key_id":      keyID,
+		"expires_at":        expiresAt,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Tokens decrypts the provider tokens stored on an identity.
+func (r *IdentityRepository) Tokens(identity *types.UserIdentity) (accessToken string, refreshToken string, err error) {
+	if r.keyring == nil {
+		return "", "", ErrNoKeyring
+	}
+	if identity.AccessTokenEnc != "" {
+		access, err := r.keyring.Open(identity.AccessTokenEnc, identity.TokenKeyID, tokenAAD(identity.ID, "access_token_enc"))
+		if err != nil {
+			return "", "", err
+		}
+		accessToken = string(access)
+	}
+	if identity.RefreshTokenEnc != "" {
+		refresh, err := r.keyring.Open(identity.RefreshTokenEnc, identity.TokenKeyID, tokenAAD(identity.ID, "refresh_token_enc"))
+		if err != nil {
+			return "", "", err
+		}
+		refreshToken = string(refresh)
+	}
+	return accessToken, refreshToken, nil
+}
+
+// tokenAAD binds a sealed token to the identity and column it is stored in, so that it can't
+// be moved to another identity or swapped with the other token.
+func tokenAAD(identityID string, column string) []byte {
+	return []byte(identityID + "/" + column)
+}
+
+// RotateTokenKeys re-wraps the tokens of every identity that isn't using the keyring's current
+// master key. Only the data keys are re-encrypted, so the tokens themselves are never decrypted
+// in bulk. Old master keys must stay in the keyring until this returns. It returns the number
+// of identities that were updated, which leaves out those whose tokens were replaced
+// concurrently.
+func (r *IdentityRepository) RotateTokenKeys() (int, error) {
+	if r.keyring == nil {
+		return 0, ErrNoKeyring
+	}
+	current := r.keyring.Current()
+	if current == "" {
+		return 0, envelope.ErrNoCurrentKey
+	}
+
+	rotated := 0
+	for {
+		var batch []*types.UserIdentity
+		if err := r.db.
+			Where("token_key_id <> ? AND token_key_id <> ''", current).
+			Limit(rotationBatchSize).
+			Find(&batch).Error; err != nil {
+			return rotated, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		updated := 0
+		if err := r.db.Transaction(func(tx *gorm.DB) error {
+			for _, identity := range batch {
+				updates := map[string]any{"token_key_id": current}
+				if identity.AccessTokenEnc != "" {
+					access, _, err := r.keyring.Rewrap(identity.AccessTokenEnc, identity.TokenKeyID, tokenAAD(identity.ID, "access_token_enc"))
+					if err != nil {
+						return err
+					}
+					updates["access_token_enc"] = access
+				}
+				if identity.RefreshTokenEnc != "" {
+					refresh, _, err := r.keyring.Rewrap(identity.RefreshTokenEnc, identity.TokenKeyID, tokenAAD(identity.ID, "refresh_token_enc"))
+					if err != nil {
+						return err
+					}
+					updates["refresh_token_enc"] = refresh
+				}
+
+				// Guard on the old key ID, in case a concurrent SetTokens already replaced the tokens.
+				result := tx.Model(&types.UserIdentity{}).
+					Where("id = ? AND token_key_id = ?", identity.ID, identity.TokenKeyID).
+					Updates(updates)
+				if result.Error != nil {
+					return result.Error
+				}
+				updated += int(result.RowsAffected)
+			}
+			return nil
+		}); err != nil {
+			return rotated, err
+		}
+		rotated += updated
+	}
+
+	if rotated > 0 {
+		log.Info("Re-wrapped provider tokens for ", rotated, " identities under key ", current, ".")
+	}
+	return rotated, nil
+}
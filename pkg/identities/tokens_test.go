@@ -0,0 +1,97 @@
+package identities
+
+import (
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/envelope"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func addKey(t *testing.T, keyring *envelope.Keyring, id string, fill byte) {
+	t.Helper()
+	key := make([]byte, envelope.KeySize)
+	for i := range key {
+		key[i] = fill
+	}
+	if err := keyring.Add(id, key, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func linkWithTokens(t *testing.T, r *IdentityRepository, id string, access string, refresh string) *types.UserIdentity {
+	t.Helper()
+	identity := &types.UserIdentity{ID: id, Provider: ProviderGitHub, ProviderUserID: id, UserID: "user"}
+	if err := r.Link(identity); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetTokens(id, access, refresh, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Where("id = ?", id).First(identity).Error; err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestTokensAreBoundToTheirIdentity(t *testing.T) {
+	r := newTestRepository(t)
+	keyring := envelope.NewKeyring()
+	addKey(t, keyring, "k1", 1)
+	r.SetKeyring(keyring)
+
+	a := linkWithTokens(t, r, "a", "access a", "refresh a")
+	b := linkWithTokens(t, r, "b", "access b", "")
+
+	access, refresh, err := r.Tokens(a)
+	if err != nil || access != "access a" || refresh != "refresh a" {
+		t.Fatalf("Tokens = %q, %q, %v", access, refresh, err)
+	}
+
+	// Copying a's token onto b, or swapping a's tokens, must not decrypt.
+	moved := *b
+	moved.AccessTokenEnc = a.AccessTokenEnc
+	if _, _, err := r.Tokens(&moved); err == nil {
+		t.Error("a token moved to another identity decrypted")
+	}
+	swapped := *a
+	swapped.AccessTokenEnc, swapped.RefreshTokenEnc = a.RefreshTokenEnc, a.AccessTokenEnc
+	if _, _, err := r.Tokens(&swapped); err == nil {
+		t.Error("swapped tokens decrypted")
+	}
+}
+
+func TestRotateTokenKeys(t *testing.T) {
+	r := newTestRepository(t)
+	keyring := envelope.NewKeyring()
+	addKey(t, keyring, "k1", 1)
+	r.SetKeyring(keyring)
+
+	linkWithTokens(t, r, "a", "access a", "refresh a")
+	linkWithTokens(t, r, "b", "access b", "")
+	addKey(t, keyring, "k2", 2)
+	linkWithTokens(t, r, "c", "access c", "")
+
+	rotated, err := r.RotateTokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 {
+		t.Errorf("rotated %d identities, want 2", rotated)
+	}
+	if rotated, err := r.RotateTokenKeys(); err != nil || rotated != 0 {
+		t.Errorf("second rotation = %d, %v, want nothing to do", rotated, err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		identity := &types.UserIdentity{}
+		if err := r.db.Where("id = ?", id).First(identity).Error; err != nil {
+			t.Fatal(err)
+		}
+		if identity.TokenKeyID != "k2" {
+			t.Errorf("identity %s is on key %q, want k2", id, identity.TokenKeyID)
+		}
+		if access, _, err := r.Tokens(identity); err != nil || access != "access "+id {
+			t.Errorf("Tokens(%s) after rotation = %q, %v", id, access, err)
+		}
+	}
+}
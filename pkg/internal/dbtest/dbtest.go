@@ -0,0 +1,34 @@
+// Package dbtest opens throwaway databases for the storage packages' tests.
+package dbtest
+
+import (
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open returns a new in-memory SQLite database with tables created for models. The database
+// is closed when the test ends.
+//
+// It has a single connection, since every connection to ":memory:" gets its own database. A
+// query that bypasses an open transaction therefore blocks, which tests should treat as a bug.
+func Open(t testing.TB, models ...any) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
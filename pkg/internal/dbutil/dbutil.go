@@ -0,0 +1,60 @@
+// Package dbutil holds the database helpers shared by the storage packages.
+package dbutil
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// LogUserEvent records a UserEvent using the given transaction, so that it is rolled back
+// together with the change it describes.
+func LogUserEvent(tx *gorm.DB, userID string, eventID string, details string, successful bool) error {
+	return tx.Create(&types.UserEvent{
+		ID:         ulid.Make().String(),
+		UserID:     userID,
+		EventID:    eventID,
+		Details:    details,
+		Successful: successful,
+	}).Error
+}
+
+// CountLoginMethods counts the ways a user can log in: a password, plus each linked identity
+// and passkey. Callers that remove one of them should lock the user row first.
+func CountLoginMethods(tx *gorm.DB, userID string) (int64, error) {
+	var identities int64
+	if err := tx.Model(&types.UserIdentity{}).Where("user_id = ?", userID).Count(&identities).Error; err != nil {
+		return 0, err
+	}
+
+	var passkeys int64
+	if err := tx.Model(&types.UserWebAuthnCredential{}).Where("user_id = ?", userID).Count(&passkeys).Error; err != nil {
+		return 0, err
+	}
+
+	var passwords int64
+	if err := tx.Model(&types.User{}).Where("id = ? AND password <> ''", userID).Count(&passwords).Error; err != nil {
+		return 0, err
+	}
+	return identities + passkeys + passwords, nil
+}
+
+// IsUniqueViolation reports whether err is a unique constraint failure from MySQL/MariaDB,
+// PostgreSQL or SQLite. Failures are detected by message, since the storage module does not
+// depend on any particular driver.
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate entry") || // MySQL, MariaDB (1062)
+		strings.Contains(msg, "duplicate key value") || // PostgreSQL (23505)
+		strings.Contains(msg, "unique constraint failed") || // SQLite
+		strings.Contains(msg, gorm.ErrDuplicatedKey.Error()) // TranslateError enabled
+}
@@ -0,0 +1,140 @@
+package dbutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RebuildTable replaces the table of model with one created from model's current schema,
+// for changes AutoMigrate can't make in place, such as a new primary key.
+//
+// DDL commits implicitly in MySQL, so dropping and re-creating the table would lose every row
+// if anything failed in between. Instead, the new table is created under a temporary name and
+// fill copies the rows into it, reading from the table named from and writing to the one named
+// to. Only then is the old table renamed away, the new one renamed into place, and the old one
+// dropped. If a previous attempt stopped between the two renames, it is finished first.
+//
+// The new table's indexes are renamed to their usual names once the old table is gone, and
+// its foreign keys are created by a final AutoMigrate. Indexes with explicit names aren't
+// supported, since they would clash with those of the old table.
+func RebuildTable(db *gorm.DB, model any, fill func(tx *gorm.DB, from string, to string) error) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	table := stmt.Schema.Table
+	tmp := table + "_rebuild"
+	old := table + "_old"
+
+	names, err := indexNames(db, model, table)
+	if err != nil {
+		return err
+	}
+	tmpNames, err := indexNames(db, model, tmp)
+	if err != nil {
+		return err
+	}
+	renames := map[string]string{}
+	for key, name := range tmpNames {
+		if name == names[key] {
+			return fmt.Errorf("can't rebuild %s: index %s has an explicit name", table, name)
+		}
+		renames[name] = names[key]
+	}
+
+	migrator := db.Migrator()
+	switch {
+	case RebuildPending(db, model):
+		// The previous attempt had already filled the new table when it stopped.
+		if err := migrator.RenameTable(tmp, table); err != nil {
+			return err
+		}
+		return finishRebuild(db, model, old, renames)
+	case migrator.HasTable(tmp):
+		// The previous attempt stopped while filling the new table.
+		if err := migrator.DropTable(tmp); err != nil {
+			return err
+		}
+	}
+
+	// Foreign keys would be named after the temporary table, and are created afterwards instead.
+	create := db.Session(&gorm.Session{})
+	config := *create.Config
+	config.DisableForeignKeyConstraintWhenMigrating = true
+	create.Config = &config
+	if err := create.Table(tmp).Migrator().CreateTable(model); err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return fill(tx, table, tmp)
+	}); err != nil {
+		return err
+	}
+
+	if err := migrator.RenameTable(table, old); err != nil {
+		return err
+	}
+	if err := migrator.RenameTable(tmp, table); err != nil {
+		return err
+	}
+	return finishRebuild(db, model, old, renames)
+}
+
+// RebuildPending reports whether a RebuildTable of model stopped between renaming the old
+// table away and renaming the new one into place, leaving the model without a table.
+// Migrations should call RebuildTable again in that case, which finishes it.
+func RebuildPending(db *gorm.DB, model any) bool {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return false
+	}
+	table := stmt.Schema.Table
+	migrator := db.Migrator()
+	return !migrator.HasTable(table) && migrator.HasTable(table+"_rebuild") && migrator.HasTable(table+"_old")
+}
+
+// finishRebuild drops the old table once the new one is in place, then gives the new table's
+// indexes their usual names and creates its foreign keys. renames maps the temporary index
+// names onto the usual ones.
+func finishRebuild(db *gorm.DB, model any, old string, renames map[string]string) error {
+	migrator := db.Migrator()
+	if err := migrator.DropTable(old); err != nil {
+		return err
+	}
+	for from, to := range renames {
+		if !migrator.HasIndex(model, from) {
+			continue
+		}
+		if err := migrator.RenameIndex(model, from, to); err != nil {
+			return err
+		}
+	}
+	return db.AutoMigrate(model)
+}
+
+// indexNames returns the names model's indexes and unique constraints get in the given table,
+// keyed by their columns. PostgreSQL also names the primary key after the table.
+func indexNames(db *gorm.DB, model any, table string) (map[string]string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.ParseWithSpecialTableName(model, table); err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{"": table + "_pkey"}
+	for _, index := range stmt.Schema.ParseIndexes() {
+		columns := make([]string, len(index.Fields))
+		for i, field := range index.Fields {
+			columns[i] = field.DBName
+		}
+		sort.Strings(columns)
+		names["index:"+strings.Join(columns, ",")] = index.Name
+	}
+	for _, constraint := range stmt.Schema.ParseUniqueConstraints() {
+		names["unique:"+constraint.Field.DBName] = constraint.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,140 @@
+package dbutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"gorm.io/gorm"
+)
+
+// widget is the old layout of the widgets table, keyed by name alone.
+type widget struct {
+	Name  string `gorm:"primaryKey"`
+	Owner string `gorm:"index"`
+}
+
+// newWidget adds a version to the primary key.
+type newWidget struct {
+	Name    string `gorm:"primaryKey"`
+	Version int    `gorm:"primaryKey;autoIncrement:false"`
+	Owner   string `gorm:"index"`
+	Serial  string `gorm:"unique"`
+}
+
+func (newWidget) TableName() string {
+	return "widgets"
+}
+
+func copyWidgets(tx *gorm.DB, from string, to string) error {
+	return tx.Exec("INSERT INTO ? (name, version, owner, serial) SELECT name, 1, owner, name FROM ?", gorm.Expr(to), gorm.Expr(from)).Error
+}
+
+func seedWidgets(t *testing.T) *gorm.DB {
+	db := dbtest.Open(t, &widget{})
+	for _, name := range []string{"a", "b", "c"} {
+		if err := db.Create(&widget{Name: name, Owner: "owner"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func checkRebuilt(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	var widgets []*newWidget
+	if err := db.Order("name").Find(&widgets).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 3 || widgets[0].Name != "a" || widgets[0].Version != 1 || widgets[2].Owner != "owner" {
+		t.Errorf("widgets after rebuild = %+v", widgets)
+	}
+
+	migrator := db.Migrator()
+	for _, table := range []string{"widgets_rebuild", "widgets_old"} {
+		if migrator.HasTable(table) {
+			t.Errorf("table %s was left behind", table)
+		}
+	}
+	if !migrator.HasIndex(&newWidget{}, "idx_widgets_owner") {
+		t.Error("index idx_widgets_owner is missing")
+	}
+	if migrator.HasIndex(&newWidget{}, "idx_widgets_rebuild_owner") {
+		t.Error("index idx_widgets_rebuild_owner was not renamed")
+	}
+	if err := db.Create(&newWidget{Name: "a", Version: 2, Serial: "d"}).Error; err != nil {
+		t.Errorf("adding a second version: %v", err)
+	}
+}
+
+func TestRebuildTable(t *testing.T) {
+	db := seedWidgets(t)
+	if err := RebuildTable(db, &newWidget{}, copyWidgets); err != nil {
+		t.Fatal(err)
+	}
+	checkRebuilt(t, db)
+}
+
+func TestRebuildTableKeepsRowsOnFailure(t *testing.T) {
+	db := seedWidgets(t)
+	failure := errors.New("fill failed")
+	err := RebuildTable(db, &newWidget{}, func(tx *gorm.DB, from string, to string) error {
+		if err := copyWidgets(tx, from, to); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("RebuildTable = %v, want the fill error", err)
+	}
+
+	var count int64
+	if err := db.Table("widgets").Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("old table has %d rows after a failed rebuild, want 3", count)
+	}
+
+	// A later attempt starts over.
+	if err := RebuildTable(db, &newWidget{}, copyWidgets); err != nil {
+		t.Fatal(err)
+	}
+	checkRebuilt(t, db)
+}
+
+func TestRebuildTableResumes(t *testing.T) {
+	db := seedWidgets(t)
+
+	// Stop right after the old table was renamed away.
+	stopped := errors.New("stopped")
+	renames := 0
+	err := db.Callback().Raw().Before("gorm:raw").Register("stop", func(tx *gorm.DB) {
+		if strings.Contains(tx.Statement.SQL.String(), "RENAME TO") {
+			if renames++; renames == 2 {
+				tx.AddError(stopped)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildTable(db, &newWidget{}, copyWidgets); !errors.Is(err, stopped) {
+		t.Fatalf("RebuildTable = %v, want it to stop", err)
+	}
+	if err := db.Callback().Raw().Remove("stop"); err != nil {
+		t.Fatal(err)
+	}
+	if !RebuildPending(db, &newWidget{}) {
+		t.Fatal("RebuildPending = false after stopping between the renames")
+	}
+
+	if err := RebuildTable(db, &newWidget{}, func(tx *gorm.DB, from string, to string) error {
+		t.Error("fill was called again")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkRebuilt(t, db)
+}
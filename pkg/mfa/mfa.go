@@ -0,0 +1,17 @@
+package mfa
+
+import (
+	"gorm.io/gorm"
+)
+
+// FactorRepository stores the second factors of users.
+type FactorRepository struct {
+	db *gorm.DB
+}
+
+func NewFactorRepository(db *gorm.DB) *FactorRepository {
+	if db == nil {
+		panic("Got nil database")
+	}
+	return &FactorRepository{db: db}
+}
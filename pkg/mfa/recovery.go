@@ -0,0 +1,220 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// DefaultRecoveryCodeCount is the number of codes in a batch when none is specified.
+const DefaultRecoveryCodeCount = 10
+
+// recoveryAlphabet leaves out characters that are easily confused, like 0/o and 1/l.
+const recoveryAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// recoveryCodeLength is the number of characters in a code, excluding the separator.
+const recoveryCodeLength = 10
+
+var ErrInvalidRecoveryCode = errors.New("invalid or already used recovery code")
+
+// GenerateRecoveryCodes creates a new batch of n recovery codes for the user, replacing any
+// existing ones. The plaintext codes are returned once and can't be retrieved afterwards.
+func (r *FactorRepository) GenerateRecoveryCodes(userID string, n int) ([]string, error) {
+	if n <= 0 {
+		n = DefaultRecoveryCodeCount
+	}
+
+	batchID := ulid.Make().String()
+	codes := make([]string, n)
+	rows := make([]*types.RecoveryCode, n)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = &types.RecoveryCode{
+			ID:       ulid.Make().String(),
+			UserID:   userID,
+			BatchID:  batchID,
+			Salt:     hex.EncodeToString(salt),
+			CodeHash: hashRecoveryCode(salt, code),
+		}
+	}
+
+	if err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&types.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&rows).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_recovery_set", batchID, true)
+	}); err != nil {
+		if logErr := dbutil.LogUserEvent(r.db, userID, "user_recovery_set_failure", batchID, false); logErr != nil {
+			return nil, logErr
+		}
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ConsumeRecoveryCode marks the matching unused code as used. Every unused code of the user is
+// compared in constant time, so the timing doesn't reveal which one matched or how close a
+// guess was. ErrInvalidRecoveryCode is returned if no code matches.
+func (r *FactorRepository) ConsumeRecoveryCode(userID string, code string, ip string) error {
+	code = normalizeRecoveryCode(code)
+
+	var candidates []*types.RecoveryCode
+	if err := r.db.Where("user_id = ? AND used_at IS NULL", userID).Find(&candidates).Error; err != nil {
+		return err
+	}
+
+	var match *types.RecoveryCode
+	for _, candidate := range candidates {
+		salt, err := hex.DecodeString(candidate.Salt)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hashRecoveryCode(salt, code)), []byte(candidate.CodeHash)) == 1 {
+			match = candidate
+		}
+	}
+
+	if match == nil {
+		if err := dbutil.LogUserEvent(r.db, userID, "user_recovery_failure", "", false); err != nil {
+			return err
+		}
+		return ErrInvalidRecoveryCode
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// The used_at check makes sure two concurrent requests can't both consume the same code.
+		result := tx.Model(&types.RecoveryCode{}).
+			Where("id = ? AND used_at IS NULL", match.ID).
+			Updates(map[string]any{"used_at": time.Now(), "used_from_ip": ip})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidRecoveryCode
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_recovery_success", match.BatchID, true)
+	})
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes the user has left.
+func (r *FactorRepository) RemainingRecoveryCodes(userID string) (int64, error) {
+	var count int64
+	err := r.db.Model(&types.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// newRecoveryCode returns a random code formatted as "xxxxx-xxxxx".
+func newRecoveryCode() (string, error) {
+	// 256 isn't a multiple of the alphabet size, so reject the values that would bias the result.
+	limit := 256 - 256%len(recoveryAlphabet)
+
+	var b strings.Builder
+	buf := make([]byte, 1)
+	for n := 0; n < recoveryCodeLength; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		if int(buf[0]) >= limit {
+			continue
+		}
+		if n == recoveryCodeLength/2 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(recoveryAlphabet[int(buf[0])%len(recoveryAlphabet)])
+		n++
+	}
+	return b.String(), nil
+}
+
+// normalizeRecoveryCode lowercases a code and strips separators, so that "ABCDE-FGHJK",
+// "abcde fghjk" and "abcdefghjk" are treated the same.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(c rune) rune {
+		if c == '-' || c == ' ' {
+			return -1
+		}
+		return c
+	}, code)
+}
+
+func hashRecoveryCode(salt []byte, code string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// legacyRecoveryCode mirrors the recovery_codes table from before codes were hashed.
+type legacyRecoveryCode struct {
+	UserID    string
+	Code      string
+	CreatedAt time.Time
+}
+
+func (legacyRecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// MigrateLegacyRecoveryCodes rebuilds the recovery_codes table if it predates hashed codes,
+// hashing the stored codes so that users can keep using them. Each user's existing codes
+// become one batch. The old table is only dropped once the new one is in place.
+// It must run before AutoMigrate.
+func MigrateLegacyRecoveryCodes(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !dbutil.RebuildPending(db, &types.RecoveryCode{}) &&
+		(!migrator.HasTable(&legacyRecoveryCode{}) || migrator.HasColumn(&legacyRecoveryCode{}, "id")) {
+		return nil
+	}
+
+	return dbutil.RebuildTable(db, &types.RecoveryCode{}, func(tx *gorm.DB, from string, to string) error {
+		var rows []*legacyRecoveryCode
+		if err := tx.Table(from).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		batches := map[string]string{}
+		for _, row := range rows {
+			batchID, ok := batches[row.UserID]
+			if !ok {
+				batchID = ulid.Make().String()
+				batches[row.UserID] = batchID
+			}
+			salt := make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+			if err := tx.Table(to).Create(&types.RecoveryCode{
+				ID:        ulid.Make().String(),
+				UserID:    row.UserID,
+				BatchID:   batchID,
+				Salt:      hex.EncodeToString(salt),
+				CodeHash:  hashRecoveryCode(salt, row.Code),
+				CreatedAt: row.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
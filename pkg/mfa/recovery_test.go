@@ -0,0 +1,133 @@
+package mfa
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"abcde-fghjk", "abcdefghjk"},
+		{"ABCDE-FGHJK", "abcdefghjk"},
+		{"abcde fghjk", "abcdefghjk"},
+		{" abcdefghjk ", "abcdefghjk"},
+	}
+	for _, test := range tests {
+		if got := normalizeRecoveryCode(test.code); got != test.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestNewRecoveryCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != recoveryCodeLength+1 || code[recoveryCodeLength/2] != '-' {
+			t.Fatalf("code %q is malformed", code)
+		}
+		for _, c := range normalizeRecoveryCode(code) {
+			if !strings.ContainsRune(recoveryAlphabet, c) {
+				t.Fatalf("code %q contains %q", code, c)
+			}
+		}
+		if seen[code] {
+			t.Fatalf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestConsumeRecoveryCode(t *testing.T) {
+	r := newTestRepository(t)
+	codes, err := r.GenerateRecoveryCodes("user", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 3 {
+		t.Fatalf("generated %d codes, want 3", len(codes))
+	}
+
+	if err := r.ConsumeRecoveryCode("user", "wrong-codes", "127.0.0.1"); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("consuming a wrong code = %v, want ErrInvalidRecoveryCode", err)
+	}
+	if err := r.ConsumeRecoveryCode("user", strings.ToUpper(codes[1]), "127.0.0.1"); err != nil {
+		t.Errorf("consuming a valid code: %v", err)
+	}
+	if err := r.ConsumeRecoveryCode("user", codes[1], "127.0.0.1"); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("consuming a used code = %v, want ErrInvalidRecoveryCode", err)
+	}
+	if remaining, err := r.RemainingRecoveryCodes("user"); err != nil || remaining != 2 {
+		t.Errorf("RemainingRecoveryCodes = %d, %v, want 2", remaining, err)
+	}
+
+	// A new batch replaces the old one.
+	if _, err := r.GenerateRecoveryCodes("user", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ConsumeRecoveryCode("user", codes[0], "127.0.0.1"); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("consuming a replaced code = %v, want ErrInvalidRecoveryCode", err)
+	}
+	if remaining, err := r.RemainingRecoveryCodes("user"); err != nil || remaining != DefaultRecoveryCodeCount {
+		t.Errorf("RemainingRecoveryCodes = %d, %v, want %d", remaining, err, DefaultRecoveryCodeCount)
+	}
+}
+
+func TestMigrateLegacyRecoveryCodes(t *testing.T) {
+	db := dbtest.Open(t, &legacyRecoveryCode{}, &types.User{}, &types.UserEvent{})
+	legacy := []*legacyRecoveryCode{
+		{UserID: "user", Code: "aaaaa-aaaaa", CreatedAt: time.Now()},
+		{UserID: "user", Code: "bbbbb-bbbbb", CreatedAt: time.Now()},
+		{UserID: "other", Code: "ccccc-ccccc", CreatedAt: time.Now()},
+	}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateLegacyRecoveryCodes(db); err != nil {
+		t.Fatal(err)
+	}
+	var codes []*types.RecoveryCode
+	if err := db.Find(&codes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 3 {
+		t.Fatalf("migrated %d codes, want 3", len(codes))
+	}
+	batches := map[string]string{}
+	for _, code := range codes {
+		if code.CodeHash == "" || strings.Contains(code.CodeHash, "aaaaa") {
+			t.Errorf("code %s isn't hashed: %q", code.ID, code.CodeHash)
+		}
+		if batch, ok := batches[code.UserID]; ok && batch != code.BatchID {
+			t.Errorf("codes of %s are in batches %s and %s", code.UserID, batch, code.BatchID)
+		}
+		batches[code.UserID] = code.BatchID
+	}
+	if batches["user"] == batches["other"] {
+		t.Error("users share a batch")
+	}
+
+	r := NewFactorRepository(db)
+	if err := r.ConsumeRecoveryCode("user", "BBBBB-BBBBB", "127.0.0.1"); err != nil {
+		t.Errorf("consuming a migrated code: %v", err)
+	}
+
+	if err := MigrateLegacyRecoveryCodes(db); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, err := r.RemainingRecoveryCodes("user"); err != nil || remaining != 1 {
+		t.Errorf("after a second run: %d codes left, %v, want 1", remaining, err)
+	}
+}
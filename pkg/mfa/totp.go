@@ -0,0 +1,298 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxAuthenticators caps the number of TOTP authenticators, pending or confirmed, per user.
+const MaxAuthenticators = 5
+
+// TOTP parameters, as used by common authenticator apps (RFC 6238 with HMAC-SHA1).
+const (
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+
+	// TOTPSkew is how many time steps before and after the current one are accepted, to allow
+	// for clock drift between the server and the authenticator.
+	TOTPSkew = 1
+)
+
+// PendingTOTPLifetime is how long an unconfirmed enrollment is kept before it is purged.
+const PendingTOTPLifetime = 15 * time.Minute
+
+var (
+	ErrAuthenticatorNotFound = errors.New("authenticator not found")
+	ErrAlreadyConfirmed      = errors.New("authenticator is already confirmed")
+	ErrTooManyAuthenticators = errors.New("too many authenticators")
+	ErrEnrollmentExpired     = errors.New("authenticator enrollment has expired")
+	ErrReplayedCode          = errors.New("code has already been used")
+	ErrInvalidCode           = errors.New("invalid code")
+	ErrInvalidSecret         = errors.New("TOTP secret must be base32-encoded")
+)
+
+// EnrollTOTP starts enrolling a new authenticator for the user. secret is the base32-encoded
+// shared secret, as shown to the user in the otpauth URI. The enrollment stays pending until
+// ConfirmTOTP is called with a valid code.
+func (r *FactorRepository) EnrollTOTP(userID string, label string, secret string) (*types.UserTOTP, error) {
+	if _, err := decodeTOTPSecret(secret); err != nil {
+		return nil, err
+	}
+	totp := &types.UserTOTP{
+		ID:     ulid.Make().String(),
+		UserID: userID,
+		Label:  label,
+		Secret: secret,
+	}
+
+	if err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the user serializes their enrollments, so that concurrent ones can't each
+		// pass the limit check.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userID).First(&types.User{}).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&types.UserTOTP{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= MaxAuthenticators {
+			return ErrTooManyAuthenticators
+		}
+		if err := tx.Create(totp).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_totp_enroll_started", label, true)
+	}); err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// ConfirmTOTP finishes a pending enrollment if code is valid for the authenticator's secret.
+// The time step it matched becomes the authenticator's LastUsedStep. Otherwise, the failure
+// is logged, ErrInvalidCode is returned and the enrollment stays pending.
+func (r *FactorRepository) ConfirmTOTP(userID string, id string, code string) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		totp := &types.UserTOTP{}
+		if err := tx.Where("id = ? AND user_id = ?", id, userID).First(totp).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrAuthenticatorNotFound
+			}
+			return err
+		}
+		if totp.Confirmed {
+			return ErrAlreadyConfirmed
+		}
+		if time.Since(totp.CreatedAt) > PendingTOTPLifetime {
+			return ErrEnrollmentExpired
+		}
+
+		step, ok := checkTOTPCode(totp.Secret, code, time.Now())
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		now := time.Now()
+		if err := tx.Model(totp).Updates(map[string]any{
+			"confirmed":      true,
+			"confirmed_at":   now,
+			"last_used_step": step,
+			"last_used_at":   now,
+		}).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_totp_enroll_success", totp.Label, true)
+	})
+
+	// The failure is logged outside of the transaction, since that was rolled back.
+	if errors.Is(err, ErrInvalidCode) {
+		if logErr := dbutil.LogUserEvent(r.db, userID, "user_totp_enroll_failure", id, false); logErr != nil {
+			return logErr
+		}
+	}
+	return err
+}
+
+// UseTOTP checks a code from one of the user's confirmed authenticators and records its time
+// step. It fails with ErrInvalidCode if the code doesn't match, and with ErrReplayedCode if
+// its step, or a later one, was already used with this authenticator.
+func (r *FactorRepository) UseTOTP(userID string, id string, code string) error {
+	totp := &types.UserTOTP{}
+	if err := r.db.Where("id = ? AND user_id = ? AND confirmed = ?", id, userID, true).First(totp).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAuthenticatorNotFound
+		}
+		return err
+	}
+	step, ok := checkTOTPCode(totp.Secret, code, time.Now())
+	if !ok {
+		if err := dbutil.LogUserEvent(r.db, userID, "user_auth_totp_error", "invalid code", false); err != nil {
+			return err
+		}
+		return ErrInvalidCode
+	}
+
+	result := r.db.Model(&types.UserTOTP{}).
+		Where("id = ? AND user_id = ? AND confirmed = ? AND last_used_step < ?", id, userID, true, step).
+		Updates(map[string]any{
+			"last_used_step": step,
+			"last_used_at":   time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	// Nothing was updated, so either the authenticator was just removed or the step is stale.
+	var count int64
+	if err := r.db.Model(&types.UserTOTP{}).Where("id = ? AND user_id = ? AND confirmed = ?", id, userID, true).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrAuthenticatorNotFound
+	}
+	if err := dbutil.LogUserEvent(r.db, userID, "user_auth_totp_error", "replayed code", false); err != nil {
+		return err
+	}
+	return ErrReplayedCode
+}
+
+// ListTOTP returns the user's authenticators. If confirmedOnly is set, pending ones are left out.
+func (r *FactorRepository) ListTOTP(userID string, confirmedOnly bool) ([]*types.UserTOTP, error) {
+	query := r.db.Where("user_id = ?", userID)
+	if confirmedOnly {
+		query = query.Where("confirmed = ?", true)
+	}
+	var totps []*types.UserTOTP
+	if err := query.Order("created_at").Find(&totps).Error; err != nil {
+		return nil, err
+	}
+	return totps, nil
+}
+
+// RemoveTOTP deletes one of the user's authenticators.
+func (r *FactorRepository) RemoveTOTP(userID string, id string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		totp := &types.UserTOTP{}
+		if err := tx.Where("id = ? AND user_id = ?", id, userID).First(totp).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrAuthenticatorNotFound
+			}
+			return err
+		}
+		if err := tx.Delete(totp).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_totp_removed", totp.Label, true)
+	})
+}
+
+// checkTOTPCode reports whether code is valid for secret at now, within TOTPSkew steps, and
+// returns the time step it matched.
+func checkTOTPCode(secret string, code string, now time.Time) (uint64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / uint64(TOTPPeriod/time.Second)
+	for offset := -TOTPSkew; offset <= TOTPSkew; offset++ {
+		step := current + uint64(offset)
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the code for a time step, as specified by RFC 4226 and RFC 6238.
+func totpCode(key []byte, step uint64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulus := uint32(1)
+	for range TOTPDigits {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%modulus)
+}
+
+// decodeTOTPSecret decodes a base32 secret. Authenticator apps accept it in lower case, with
+// spaces and without padding, so the same is allowed here.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// PurgePendingTOTP deletes enrollments that were never confirmed within PendingTOTPLifetime.
+func (r *FactorRepository) PurgePendingTOTP() (int64, error) {
+	result := r.db.Where("confirmed = ? AND created_at < ?", false, time.Now().Add(-PendingTOTPLifetime)).Delete(&types.UserTOTP{})
+	return result.RowsAffected, result.Error
+}
+
+// legacyTOTP mirrors the user_totps table from before authenticators had IDs.
+type legacyTOTP struct {
+	UserID    string
+	Secret    string
+	CreatedAt time.Time
+}
+
+func (legacyTOTP) TableName() string {
+	return "user_totps"
+}
+
+// MigrateLegacyTOTP rebuilds the user_totps table if it predates authenticator IDs. Existing
+// secrets were already in use, so they are carried over as confirmed authenticators. The old
+// table is only dropped once the new one is in place.
+// It must run before AutoMigrate, which can't add a primary key to a populated table.
+func MigrateLegacyTOTP(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !dbutil.RebuildPending(db, &types.UserTOTP{}) &&
+		(!migrator.HasTable(&legacyTOTP{}) || migrator.HasColumn(&legacyTOTP{}, "id")) {
+		return nil
+	}
+
+	return dbutil.RebuildTable(db, &types.UserTOTP{}, func(tx *gorm.DB, from string, to string) error {
+		var rows []*legacyTOTP
+		if err := tx.Table(from).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			confirmedAt := row.CreatedAt
+			if err := tx.Table(to).Create(&types.UserTOTP{
+				ID:          ulid.Make().String(),
+				UserID:      row.UserID,
+				Label:       "Authenticator",
+				Secret:      row.Secret,
+				Confirmed:   true,
+				ConfirmedAt: &confirmedAt,
+				CreatedAt:   row.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,162 @@
+package mfa
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// testSecret is the RFC 6238 test key "12345678901234567890", base32-encoded.
+const testSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func newTestRepository(t *testing.T) *FactorRepository {
+	db := dbtest.Open(t, &types.User{}, &types.UserTOTP{}, &types.RecoveryCode{}, &types.UserEvent{},
+		&types.UserWebAuthnCredential{}, &types.UserIdentity{})
+	if err := db.Create(&types.User{ID: "user", Username: "user", Email: "user@example.com"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewFactorRepository(db)
+}
+
+func codeAt(t *testing.T, now time.Time) string {
+	t.Helper()
+	key, err := decodeTOTPSecret(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, uint64(now.Unix())/uint64(TOTPPeriod/time.Second))
+}
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 vectors of RFC 6238, truncated to six digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := codeAt(t, time.Unix(test.unix, 0)); code != test.code {
+			t.Errorf("code at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestCheckTOTPCode(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"current", testSecret, codeAt(t, now), true},
+		{"previous step", testSecret, codeAt(t, now.Add(-TOTPPeriod)), true},
+		{"next step", testSecret, codeAt(t, now.Add(TOTPPeriod)), true},
+		{"too old", testSecret, codeAt(t, now.Add(-3*TOTPPeriod)), false},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", codeAt(t, now), true},
+		{"wrong length", testSecret, codeAt(t, now)[:5], false},
+		{"invalid secret", "not base32!", "123456", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := checkTOTPCode(test.secret, test.code, now); ok != test.ok {
+				t.Errorf("checkTOTPCode = %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestConfirmAndUseTOTP(t *testing.T) {
+	r := newTestRepository(t)
+	totp, err := r.EnrollTOTP("user", "Phone", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ConfirmTOTP("user", totp.ID, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("ConfirmTOTP with a wrong code = %v, want ErrInvalidCode", err)
+	}
+	if err := r.UseTOTP("user", totp.ID, codeAt(t, time.Now())); !errors.Is(err, ErrAuthenticatorNotFound) {
+		t.Fatalf("UseTOTP before confirming = %v, want ErrAuthenticatorNotFound", err)
+	}
+
+	code := codeAt(t, time.Now())
+	if err := r.ConfirmTOTP("user", totp.ID, code); err != nil {
+		t.Fatalf("ConfirmTOTP with a valid code: %v", err)
+	}
+	if err := r.UseTOTP("user", totp.ID, code); !errors.Is(err, ErrReplayedCode) {
+		t.Errorf("UseTOTP with the confirmation code = %v, want ErrReplayedCode", err)
+	}
+	if err := r.UseTOTP("user", totp.ID, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("UseTOTP with a wrong code = %v, want ErrInvalidCode", err)
+	}
+	if err := r.UseTOTP("user", totp.ID, codeAt(t, time.Now().Add(TOTPPeriod))); err != nil {
+		t.Errorf("UseTOTP with the next code: %v", err)
+	}
+}
+
+func TestEnrollTOTPLimit(t *testing.T) {
+	r := newTestRepository(t)
+	for i := 0; i < MaxAuthenticators; i++ {
+		if _, err := r.EnrollTOTP("user", "Phone", testSecret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.EnrollTOTP("user", "Phone", testSecret); !errors.Is(err, ErrTooManyAuthenticators) {
+		t.Errorf("enrolling past the limit = %v, want ErrTooManyAuthenticators", err)
+	}
+	if _, err := r.EnrollTOTP("user", "Phone", "not base32!"); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("enrolling an invalid secret = %v, want ErrInvalidSecret", err)
+	}
+	if _, err := r.EnrollTOTP("missing", "Phone", testSecret); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("enrolling for a missing user = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestMigrateLegacyTOTP(t *testing.T) {
+	db := dbtest.Open(t, &legacyTOTP{}, &types.User{})
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, userID := range []string{"a", "b"} {
+		if err := db.Create(&legacyTOTP{UserID: userID, Secret: testSecret, CreatedAt: created}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateLegacyTOTP(db); err != nil {
+		t.Fatal(err)
+	}
+	var totps []*types.UserTOTP
+	if err := db.Order("user_id").Find(&totps).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(totps) != 2 {
+		t.Fatalf("migrated %d authenticators, want 2", len(totps))
+	}
+	for _, totp := range totps {
+		if totp.ID == "" || !totp.Confirmed || totp.Secret != testSecret || !totp.CreatedAt.Equal(created) {
+			t.Errorf("migrated authenticator = %+v", totp)
+		}
+	}
+	if !db.Migrator().HasIndex(&types.UserTOTP{}, "idx_user_totps_user_id") {
+		t.Error("index idx_user_totps_user_id is missing")
+	}
+
+	// Running it again does nothing.
+	if err := MigrateLegacyTOTP(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := db.Model(&types.UserTOTP{}).Count(&count).Error; err != nil || count != 2 {
+		t.Errorf("after a second run: %d authenticators, %v", count, err)
+	}
+}
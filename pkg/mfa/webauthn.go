@@ -0,0 +1,158 @@
+package mfa
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrCredentialNotFound = errors.New("passkey not found")
+	ErrCredentialExists   = errors.New("passkey is already registered")
+	ErrCloneDetected      = errors.New("passkey signature counter went backwards")
+	ErrLastLoginMethod    = errors.New("cannot remove the last login method")
+)
+
+// RegisterPasskey stores a newly registered WebAuthn credential.
+func (r *FactorRepository) RegisterPasskey(credential *types.UserWebAuthnCredential) error {
+	if credential.ID == "" {
+		credential.ID = ulid.Make().String()
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&types.UserWebAuthnCredential{}).Where("credential_id = ?", credential.CredentialID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrCredentialExists
+		}
+		if err := tx.Create(credential).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, credential.UserID, "user_passkey_registered", credential.Nickname, true)
+	})
+}
+
+// GetPasskey returns the credential with the given WebAuthn credential ID.
+func (r *FactorRepository) GetPasskey(credentialID []byte) (*types.UserWebAuthnCredential, error) {
+	credential := &types.UserWebAuthnCredential{}
+	if err := r.db.Where("credential_id = ?", credentialID).First(credential).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCredentialNotFound
+		}
+		return nil, err
+	}
+	return credential, nil
+}
+
+// ListPasskeys returns every credential registered by the user.
+func (r *FactorRepository) ListPasskeys(userID string) ([]*types.UserWebAuthnCredential, error) {
+	var credentials []*types.UserWebAuthnCredential
+	if err := r.db.Where("user_id = ?", userID).Order("created_at").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// UsePasskey records a successful assertion with the new signature counter and backup state.
+// Authenticators that don't implement counters always report zero; otherwise the counter must
+// increase, and if it doesn't the credential is flagged and ErrCloneDetected is returned.
+// The check is part of the update, so two assertions racing with the same counter can't
+// both succeed.
+func (r *FactorRepository) UsePasskey(credentialID []byte, signCount uint32, backupState bool) error {
+	var cloned bool
+	var userID string
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		credential := &types.UserWebAuthnCredential{}
+		if err := tx.Where("credential_id = ?", credentialID).First(credential).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCredentialNotFound
+			}
+			return err
+		}
+		userID = credential.UserID
+
+		update := tx.Model(credential)
+		if signCount != 0 || credential.SignCount != 0 {
+			update = update.Where("sign_count < ?", signCount)
+		}
+		result := update.Updates(map[string]any{
+			"sign_count":   signCount,
+			"backup_state": backupState,
+			"last_used_at": time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			cloned = true
+			return tx.Model(credential).Update("clone_warning", true).Error
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_passkey_used", credential.Nickname, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	if cloned {
+		if err := dbutil.LogUserEvent(r.db, userID, "user_passkey_clone_warning", "", false); err != nil {
+			return err
+		}
+		return ErrCloneDetected
+	}
+	return nil
+}
+
+// RenamePasskey changes the nickname shown for one of the user's credentials.
+func (r *FactorRepository) RenamePasskey(userID string, id string, nickname string) error {
+	result := r.db.Model(&types.UserWebAuthnCredential{}).Where("id = ? AND user_id = ?", id, userID).Update("nickname", nickname)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// RemovePasskey deletes one of the user's credentials. It refuses with ErrLastLoginMethod if
+// the user would be left without any way to log in.
+func (r *FactorRepository) RemovePasskey(userID string, id string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the user serializes the removal of login methods, so that concurrent ones
+		// can't each see another method left and together remove them all.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userID).First(&types.User{}).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCredentialNotFound
+			}
+			return err
+		}
+
+		credential := &types.UserWebAuthnCredential{}
+		if err := tx.Where("id = ? AND user_id = ?", id, userID).First(credential).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCredentialNotFound
+			}
+			return err
+		}
+
+		methods, err := dbutil.CountLoginMethods(tx, userID)
+		if err != nil {
+			return err
+		}
+		if methods <= 1 {
+			return ErrLastLoginMethod
+		}
+
+		if err := tx.Delete(credential).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_passkey_removed", credential.Nickname, true)
+	})
+}
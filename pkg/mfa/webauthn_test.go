@@ -0,0 +1,107 @@
+package mfa
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func registerPasskey(t *testing.T, r *FactorRepository, credentialID string, signCount uint32) *types.UserWebAuthnCredential {
+	t.Helper()
+	credential := &types.UserWebAuthnCredential{
+		UserID:       "user",
+		CredentialID: []byte(credentialID),
+		PublicKey:    []byte("key"),
+		SignCount:    signCount,
+		Nickname:     credentialID,
+	}
+	if err := r.RegisterPasskey(credential); err != nil {
+		t.Fatal(err)
+	}
+	return credential
+}
+
+func TestRegisterPasskey(t *testing.T) {
+	r := newTestRepository(t)
+	registerPasskey(t, r, "key", 0)
+	err := r.RegisterPasskey(&types.UserWebAuthnCredential{UserID: "user", CredentialID: []byte("key"), PublicKey: []byte("key")})
+	if !errors.Is(err, ErrCredentialExists) {
+		t.Errorf("registering the same credential twice = %v, want %v", err, ErrCredentialExists)
+	}
+}
+
+func TestUsePasskey(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored uint32
+		used   uint32
+		want   error
+	}{
+		{"no counter", 0, 0, nil},
+		{"counter starts", 0, 1, nil},
+		{"counter increases", 5, 6, nil},
+		{"counter repeats", 5, 5, ErrCloneDetected},
+		{"counter goes back", 5, 4, ErrCloneDetected},
+		{"counter stops", 5, 0, ErrCloneDetected},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			registerPasskey(t, r, "key", test.stored)
+
+			if err := r.UsePasskey([]byte("key"), test.used, false); !errors.Is(err, test.want) {
+				t.Fatalf("UsePasskey(%d) = %v, want %v", test.used, err, test.want)
+			}
+			credential, err := r.GetPasskey([]byte("key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credential.CloneWarning != (test.want != nil) {
+				t.Errorf("CloneWarning = %v, want %v", credential.CloneWarning, test.want != nil)
+			}
+			if test.want == nil && credential.SignCount != test.used {
+				t.Errorf("SignCount = %d, want %d", credential.SignCount, test.used)
+			}
+			if test.want != nil && credential.SignCount != test.stored {
+				t.Errorf("SignCount = %d, want it left at %d", credential.SignCount, test.stored)
+			}
+		})
+	}
+
+	r := newTestRepository(t)
+	if err := r.UsePasskey([]byte("missing"), 1, false); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("UsePasskey on a missing credential = %v, want %v", err, ErrCredentialNotFound)
+	}
+}
+
+func TestRemovePasskey(t *testing.T) {
+	r := newTestRepository(t)
+	first := registerPasskey(t, r, "first", 0)
+	second := registerPasskey(t, r, "second", 0)
+
+	if err := r.RemovePasskey("user", first.ID); err != nil {
+		t.Fatalf("removing one of two passkeys: %v", err)
+	}
+	if err := r.RemovePasskey("user", second.ID); !errors.Is(err, ErrLastLoginMethod) {
+		t.Fatalf("removing the last login method = %v, want %v", err, ErrLastLoginMethod)
+	}
+	if err := r.RemovePasskey("user", first.ID); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("removing a removed passkey = %v, want %v", err, ErrCredentialNotFound)
+	}
+
+	// With a password left, the last passkey can go.
+	if err := r.db.Model(&types.User{}).Where("id = ?", "user").Update("password", "hash").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemovePasskey("user", second.ID); err != nil {
+		t.Errorf("removing a passkey with a password left: %v", err)
+	}
+	passkeys, err := r.ListPasskeys("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 0 {
+		t.Errorf("%d passkeys left, want 0", len(passkeys))
+	}
+}
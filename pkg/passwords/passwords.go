@@ -0,0 +1,351 @@
+package passwords
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmSHA256   = "sha256"
+	AlgorithmSHA1     = "sha1"
+	AlgorithmMD5      = "md5"
+	AlgorithmUnknown  = "unknown"
+)
+
+// DefaultHistorySize is how many previous passwords are kept to prevent reuse.
+const DefaultHistorySize = 5
+
+var (
+	ErrNoPassword     = errors.New("user has no password set")
+	ErrWrongPassword  = errors.New("wrong password")
+	ErrPasswordReused = errors.New("password was used recently")
+	ErrNoHasher       = errors.New("no hasher registered for algorithm")
+)
+
+// Hasher implements a password hashing algorithm. The accounts service provides these, so
+// that the storage module doesn't depend on any particular hashing library.
+type Hasher interface {
+	// Algorithm returns the name stored in UserPassword.Algorithm, e.g. AlgorithmArgon2id.
+	Algorithm() string
+
+	// Params returns the parameters currently used for new hashes, in the same format as Hash.
+	Params() string
+
+	// Hash returns the hash of password along with the parameters used to produce it.
+	Hash(password string) (hash string, params string, err error)
+
+	// Verify reports whether password matches hash.
+	Verify(password string, hash string, params string) (bool, error)
+}
+
+// PasswordStore stores password hashes, keeps a history of previous ones and upgrades hashes
+// made with legacy algorithms or parameters on the next successful login.
+type PasswordStore struct {
+	db          *gorm.DB
+	hashers     map[string]Hasher
+	preferred   Hasher
+	historySize int
+}
+
+// NewPasswordStore creates a PasswordStore that hashes new passwords with preferred. Legacy
+// hashers are only used to verify existing hashes.
+func NewPasswordStore(db *gorm.DB, preferred Hasher, legacy ...Hasher) *PasswordStore {
+	if db == nil {
+		panic("Got nil database")
+	}
+	s := &PasswordStore{
+		db:          db,
+		hashers:     map[string]Hasher{preferred.Algorithm(): preferred},
+		preferred:   preferred,
+		historySize: DefaultHistorySize,
+	}
+	for _, hasher := range legacy {
+		s.hashers[hasher.Algorithm()] = hasher
+	}
+	return s
+}
+
+// SetHistorySize changes how many previous passwords are checked for reuse. Zero disables the check.
+func (s *PasswordStore) SetHistorySize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	s.historySize = size
+}
+
+// HasPassword reports whether the user has a password set.
+func (s *PasswordStore) HasPassword(userID string) (bool, error) {
+	_, err := s.Current(userID)
+	if errors.Is(err, ErrNoPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Current returns the user's current password record, or ErrNoPassword if they have none.
+//
+// User.Password is still written directly by other services, so it is treated as the source
+// of truth: if it differs from the current record, a new record is created for it with
+// DetectAlgorithm and the old one is moved to the history.
+func (s *PasswordStore) Current(userID string) (*types.UserPassword, error) {
+	var current *types.UserPassword
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user := &types.User{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "password").Where("id = ?", userID).First(user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoPassword
+			}
+			return err
+		}
+		if user.Password == "" {
+			return ErrNoPassword
+		}
+
+		current = &types.UserPassword{}
+		err := tx.Where("user_id = ? AND is_current = ?", userID, true).First(current).Error
+		if err == nil && current.Hash == user.Password {
+			return nil
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// The hash was changed without going through the store.
+		if err := tx.Model(&types.UserPassword{}).Where("user_id = ? AND is_current = ?", userID, true).Update("is_current", false).Error; err != nil {
+			return err
+		}
+		algorithm, params := DetectAlgorithm(user.Password)
+		current = &types.UserPassword{
+			ID:        ulid.Make().String(),
+			UserID:    userID,
+			Algorithm: algorithm,
+			Params:    params,
+			Hash:      user.Password,
+			IsCurrent: true,
+			ChangedAt: time.Now(),
+		}
+		if err := tx.Create(current).Error; err != nil {
+			return err
+		}
+		return s.pruneHistory(tx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// SetPassword hashes and stores a new password for the user. It fails with ErrPasswordReused
+// if the password matches the current one or any in the history, unless the history size is
+// zero.
+func (s *PasswordStore) SetPassword(userID string, password string) error {
+	var history []*types.UserPassword
+	// The current password plus historySize previous ones.
+	if s.historySize > 0 {
+		if err := s.db.Where("user_id = ?", userID).Order("is_current DESC, changed_at DESC").Limit(s.historySize + 1).Find(&history).Error; err != nil {
+			return err
+		}
+	}
+	for _, previous := range history {
+		hasher, ok := s.hashers[previous.Algorithm]
+		if !ok {
+			continue
+		}
+		if match, err := hasher.Verify(password, previous.Hash, previous.Params); err != nil {
+			return err
+		} else if match {
+			if err := dbutil.LogUserEvent(s.db, userID, "user_password_reused", "", false); err != nil {
+				return err
+			}
+			return ErrPasswordReused
+		}
+	}
+
+	hash, params, err := s.preferred.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&types.UserPassword{}).Where("user_id = ? AND is_current = ?", userID, true).Update("is_current", false).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&types.UserPassword{
+			ID:        ulid.Make().String(),
+			UserID:    userID,
+			Algorithm: s.preferred.Algorithm(),
+			Params:    params,
+			Hash:      hash,
+			IsCurrent: true,
+			ChangedAt: now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&types.User{}).Where("id = ?", userID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		if err := s.pruneHistory(tx, userID); err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_password_changed", "", true)
+	})
+}
+
+// Verify checks a password against the user's current hash. If it matches but was hashed with
+// a legacy algorithm or outdated parameters, it is transparently rehashed with the preferred
+// hasher. Rehashing doesn't count as a password change, so ChangedAt is kept.
+func (s *PasswordStore) Verify(userID string, password string) error {
+	current, err := s.Current(userID)
+	if err != nil {
+		return err
+	}
+
+	hasher, ok := s.hashers[current.Algorithm]
+	if !ok {
+		return ErrNoHasher
+	}
+	match, err := hasher.Verify(password, current.Hash, current.Params)
+	if err != nil {
+		return err
+	}
+	if !match {
+		if err := dbutil.LogUserEvent(s.db, userID, "user_auth_password_error", "", false); err != nil {
+			return err
+		}
+		return ErrWrongPassword
+	}
+
+	if s.needsRehash(current) {
+		// A failed upgrade shouldn't fail the login, since the password was correct.
+		if err := s.rehash(current, password); err != nil {
+			log.Warn("Failed to upgrade password hash for user ", userID, ": ", err)
+		}
+	}
+	return nil
+}
+
+// needsRehash reports whether a hash was made with anything other than the preferred hasher
+// and its current parameters.
+func (s *PasswordStore) needsRehash(current *types.UserPassword) bool {
+	if current.Algorithm != s.preferred.Algorithm() {
+		return true
+	}
+	return current.Params != s.preferred.Params()
+}
+
+func (s *PasswordStore) rehash(current *types.UserPassword, password string) error {
+	hash, params, err := s.preferred.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Guard on the old hash, in case the password was changed in the meantime.
+		result := tx.Model(&types.UserPassword{}).Where("id = ? AND hash = ?", current.ID, current.Hash).Updates(map[string]any{
+			"algorithm": s.preferred.Algorithm(),
+			"params":    params,
+			"hash":      hash,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := tx.Model(&types.User{}).Where("id = ?", current.UserID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, current.UserID, "user_password_rehashed", current.Algorithm+" -> "+s.preferred.Algorithm(), true)
+	})
+}
+
+// pruneHistory deletes all but the most recent historySize non-current passwords.
+func (s *PasswordStore) pruneHistory(tx *gorm.DB, userID string) error {
+	var keep []string
+	if err := tx.Model(&types.UserPassword{}).
+		Where("user_id = ? AND is_current = ?", userID, false).
+		Order("changed_at DESC").
+		Limit(s.historySize).
+		Pluck("id", &keep).Error; err != nil {
+		return err
+	}
+
+	query := tx.Where("user_id = ? AND is_current = ?", userID, false)
+	if len(keep) > 0 {
+		query = query.Where("id NOT IN ?", keep)
+	}
+	return query.Delete(&types.UserPassword{}).Error
+}
+
+var (
+	bcryptPattern = regexp.MustCompile(`^\$2[abxy]?\$(\d{2})\$`)
+	argon2Pattern = regexp.MustCompile(`^\$argon2id\$v=\d+\$([^$]+)\$`)
+	hexPattern    = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// DetectAlgorithm guesses the algorithm and parameters of an existing hash from its format.
+// It is used to classify hashes carried over from the legacy database.
+func DetectAlgorithm(hash string) (algorithm string, params string) {
+	if m := argon2Pattern.FindStringSubmatch(hash); m != nil {
+		return AlgorithmArgon2id, m[1]
+	}
+	if m := bcryptPattern.FindStringSubmatch(hash); m != nil {
+		return AlgorithmBcrypt, "cost=" + strings.TrimLeft(m[1], "0")
+	}
+	if hexPattern.MatchString(hash) {
+		switch len(hash) {
+		case 64:
+			return AlgorithmSHA256, ""
+		case 40:
+			return AlgorithmSHA1, ""
+		case 32:
+			return AlgorithmMD5, ""
+		}
+	}
+	return AlgorithmUnknown, ""
+}
+
+// MigrateLegacyPasswords creates a current UserPassword for every user that has a hash in
+// User.Password but no password record yet, classifying the hash with DetectAlgorithm.
+func MigrateLegacyPasswords(db *gorm.DB) error {
+	var users []*types.User
+	if err := db.Unscoped().
+		Where("password <> '' AND NOT EXISTS (?)", db.Model(&types.UserPassword{}).Select("1").Where("user_passwords.user_id = users.id")).
+		Find(&users).Error; err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		for _, user := range users {
+			algorithm, params := DetectAlgorithm(user.Password)
+			if err := tx.Create(&types.UserPassword{
+				ID:        ulid.Make().String(),
+				UserID:    user.ID,
+				Algorithm: algorithm,
+				Params:    params,
+				Hash:      user.Password,
+				IsCurrent: true,
+				ChangedAt: user.UpdatedAt,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("Created password records for ", len(users), " users.")
+	return nil
+}
@@ -0,0 +1,214 @@
+package passwords
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+// testHasher "hashes" by prefixing the password with its params, which is enough to tell
+// hashers and parameters apart.
+type testHasher struct {
+	algorithm string
+	params    string
+}
+
+func (h *testHasher) Algorithm() string { return h.algorithm }
+func (h *testHasher) Params() string    { return h.params }
+
+func (h *testHasher) Hash(password string) (string, string, error) {
+	return h.params + ":" + password, h.params, nil
+}
+
+func (h *testHasher) Verify(password string, hash string, params string) (bool, error) {
+	return hash == params+":"+password, nil
+}
+
+// sha256Hasher is an unsalted SHA-256 hasher like the ones of the legacy database, whose
+// hashes DetectAlgorithm recognizes.
+type sha256Hasher struct{}
+
+func (sha256Hasher) Algorithm() string { return AlgorithmSHA256 }
+func (sha256Hasher) Params() string    { return "" }
+
+func (sha256Hasher) Hash(password string) (string, string, error) {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:]), "", nil
+}
+
+func (h sha256Hasher) Verify(password string, hash string, params string) (bool, error) {
+	want, _, _ := h.Hash(password)
+	return hash == want, nil
+}
+
+func newTestStore(t *testing.T, preferred Hasher, legacy ...Hasher) *PasswordStore {
+	db := dbtest.Open(t, &types.User{}, &types.UserPassword{}, &types.UserEvent{})
+	if err := db.Create(&types.User{ID: "user", Username: "user", Email: "user@example.com"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewPasswordStore(db, preferred, legacy...)
+}
+
+func TestPasswordHistory(t *testing.T) {
+	tests := []struct {
+		name        string
+		historySize int
+		reuse       string
+		want        error
+	}{
+		{"current password", 2, "c", ErrPasswordReused},
+		{"in history", 2, "a", ErrPasswordReused},
+		{"pruned from history", 1, "a", nil},
+		{"history disabled", 0, "c", nil},
+		{"new password", 2, "d", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t, &testHasher{AlgorithmArgon2id, "v1"})
+			s.SetHistorySize(test.historySize)
+			for _, password := range []string{"a", "b", "c"} {
+				if err := s.SetPassword("user", password); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.SetPassword("user", test.reuse); !errors.Is(err, test.want) {
+				t.Errorf("SetPassword(%q) = %v, want %v", test.reuse, err, test.want)
+			}
+
+			var count int64
+			if err := s.db.Model(&types.UserPassword{}).Where("user_id = ?", "user").Count(&count).Error; err != nil {
+				t.Fatal(err)
+			}
+			if max := int64(test.historySize + 1); count > max {
+				t.Errorf("kept %d passwords, want at most %d", count, max)
+			}
+		})
+	}
+}
+
+func TestVerifyRehashes(t *testing.T) {
+	legacy := &testHasher{AlgorithmSHA256, "legacy"}
+	s := newTestStore(t, legacy)
+	if err := s.SetPassword("user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	preferred := &testHasher{AlgorithmArgon2id, "v2"}
+	s = NewPasswordStore(s.db, preferred, legacy)
+	if err := s.Verify("user", "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Verify with a wrong password = %v, want ErrWrongPassword", err)
+	}
+	if err := s.Verify("user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	current, err := s.Current("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Algorithm != AlgorithmArgon2id || current.Params != "v2" {
+		t.Errorf("after Verify the hash is %s %s, want %s v2", current.Algorithm, current.Params, AlgorithmArgon2id)
+	}
+	if err := s.Verify("user", "secret"); err != nil {
+		t.Errorf("Verify after rehashing: %v", err)
+	}
+}
+
+func TestVerifyFollowsUserPassword(t *testing.T) {
+	s := newTestStore(t, &testHasher{AlgorithmArgon2id, "v1"}, sha256Hasher{})
+	if err := s.SetPassword("user", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another service changes the hash without going through the store.
+	hash, _, _ := sha256Hasher{}.Hash("new")
+	if err := s.db.Model(&types.User{}).Where("id = ?", "user").Update("password", hash).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify("user", "old"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Verify with the replaced password = %v, want ErrWrongPassword", err)
+	}
+	if err := s.Verify("user", "new"); err != nil {
+		t.Fatalf("Verify with the new password: %v", err)
+	}
+	current, err := s.Current("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Algorithm != AlgorithmArgon2id || current.Params != "v1" {
+		t.Errorf("after Verify the hash is %s %s, want %s v1", current.Algorithm, current.Params, AlgorithmArgon2id)
+	}
+	if err := s.SetPassword("user", "old"); !errors.Is(err, ErrPasswordReused) {
+		t.Errorf("SetPassword with the replaced password = %v, want ErrPasswordReused", err)
+	}
+
+	// Clearing the hash removes the password.
+	if err := s.db.Model(&types.User{}).Where("id = ?", "user").Update("password", "").Error; err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.HasPassword("user"); ok || err != nil {
+		t.Errorf("HasPassword after clearing the hash = %v, %v, want false", ok, err)
+	}
+}
+
+func TestDetectAlgorithm(t *testing.T) {
+	tests := []struct {
+		hash      string
+		algorithm string
+		params    string
+	}{
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA", AlgorithmArgon2id, "m=65536,t=3,p=4"},
+		{"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", AlgorithmBcrypt, "cost=10"},
+		{"$2y$04$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", AlgorithmBcrypt, "cost=4"},
+		{"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", AlgorithmSHA256, ""},
+		{"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8", AlgorithmSHA1, ""},
+		{"5f4dcc3b5aa765d61d8327deb882cf99", AlgorithmMD5, ""},
+		{"5f4dcc3b5aa765d61d8327deb882cf9", AlgorithmUnknown, ""},
+		{"password", AlgorithmUnknown, ""},
+	}
+	for _, test := range tests {
+		algorithm, params := DetectAlgorithm(test.hash)
+		if algorithm != test.algorithm || params != test.params {
+			t.Errorf("DetectAlgorithm(%q) = %s, %q, want %s, %q", test.hash, algorithm, params, test.algorithm, test.params)
+		}
+	}
+}
+
+func TestMigrateLegacyPasswords(t *testing.T) {
+	s := newTestStore(t, &testHasher{AlgorithmArgon2id, "v1"})
+	users := []*types.User{
+		{ID: "legacy", Username: "legacy", Email: "legacy@example.com", Password: "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{ID: "oauth", Username: "oauth", Email: "oauth@example.com"},
+	}
+	if err := s.db.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	// user already has a password record.
+	if err := s.SetPassword("user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := MigrateLegacyPasswords(s.db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, err := s.Current("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Algorithm != AlgorithmMD5 || current.Hash != users[0].Password {
+		t.Errorf("migrated password = %s %s", current.Algorithm, current.Hash)
+	}
+	if _, err := s.Current("oauth"); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("Current for a user without a password = %v, want ErrNoPassword", err)
+	}
+	var count int64
+	if err := s.db.Model(&types.UserPassword{}).Count(&count).Error; err != nil || count != 2 {
+		t.Errorf("%d password records, %v, want 2", count, err)
+	}
+}
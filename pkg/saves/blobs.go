@@ -0,0 +1,147 @@
+package saves
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/blobs"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// DefaultBlobThreshold is the stored size from which saves are moved to the blob store.
+const DefaultBlobThreshold = 64 << 10
+
+// DefaultBlobGracePeriod is how old an unreferenced blob must be before it is collected. It
+// covers the time between a blob being stored and the transaction referencing it committing.
+const DefaultBlobGracePeriod = time.Hour
+
+// blobCheckBatchSize is how many blob keys are checked for references per query.
+const blobCheckBatchSize = 500
+
+var ErrNoBlobStore = errors.New("save is in the blob store, but none is configured")
+
+// SetBlobStore moves saves whose stored size is at least threshold bytes out of the database
+// and into store. Existing saves stay where they are until they are next written. A
+// non-positive threshold uses DefaultBlobThreshold.
+func (r *SaveRepository) SetBlobStore(store blobs.BlobStore, threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultBlobThreshold
+	}
+	r.blobs = store
+	r.blobThreshold = threshold
+}
+
+// storeData decides where encrypted save data is kept. Large data is written to the blob store
+// and its key is returned instead of the data itself.
+func (r *SaveRepository) storeData(encrypted string) (string, *string, error) {
+	if r.blobs == nil || len(encrypted) < r.blobThreshold {
+		return encrypted, nil, nil
+	}
+	key := blobs.Key([]byte(encrypted))
+	if err := r.blobs.Put(key, []byte(encrypted)); err != nil {
+		return "", nil, err
+	}
+	return "", &key, nil
+}
+
+// loadData returns the encrypted data of a save or revision, wherever it is kept.
+func (r *SaveRepository) loadData(saveData string, blobKey *string) (string, error) {
+	if blobKey == nil {
+		return saveData, nil
+	}
+	if r.blobs == nil {
+		return "", ErrNoBlobStore
+	}
+	data, err := r.blobs.Get(*blobKey)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// CollectBlobs deletes blobs that no save or revision refers to anymore, such as those of
+// overwritten or deleted saves. Blobs younger than grace are skipped, since a write may be
+// about to reference them.
+// Saves and revisions are checked in a single statement, so that a blob moving between them,
+// e.g. during a restore, is seen in one or the other. Each blob is checked again right before
+// it is deleted, in case a write reused it since it was listed.
+func (r *SaveRepository) CollectBlobs(grace time.Duration) (int, error) {
+	if r.blobs == nil {
+		return 0, nil
+	}
+
+	cutoff := time.Now().Add(-grace)
+	var candidates []string
+	if err := r.blobs.List(func(info *blobs.BlobInfo) error {
+		if info.ModifiedAt.Before(cutoff) {
+			candidates = append(candidates, info.Key)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for start := 0; start < len(candidates); start += blobCheckBatchSize {
+		batch := candidates[start:min(start+blobCheckBatchSize, len(candidates))]
+
+		var keys []string
+		if err := r.db.Raw(
+			"SELECT blob_key FROM user_game_saves WHERE blob_key IN ? UNION SELECT blob_key FROM user_game_save_revisions WHERE blob_key IN ?",
+			batch, batch,
+		).Scan(&keys).Error; err != nil {
+			return deleted, err
+		}
+		referenced := map[string]bool{}
+		for _, key := range keys {
+			referenced[key] = true
+		}
+
+		for _, key := range batch {
+			if referenced[key] {
+				continue
+			}
+			info, err := r.blobs.Stat(key)
+			if errors.Is(err, blobs.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return deleted, err
+			}
+			if !info.ModifiedAt.Before(cutoff) {
+				continue
+			}
+			if err := r.blobs.Delete(key); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// StartBlobCollector runs CollectBlobs every interval in the background until the returned
+// function is called.
+func (r *SaveRepository) StartBlobCollector(interval time.Duration, grace time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count, err := r.CollectBlobs(grace)
+				if err != nil {
+					log.Error("Failed to collect save blobs: ", err)
+					continue
+				}
+				if count > 0 {
+					log.Debug("Collected ", count, " unreferenced save blobs.")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
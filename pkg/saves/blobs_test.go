@@ -0,0 +1,196 @@
+package saves
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/blobs"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+// reusingStore stores the blobs in reuse again after every List, like a write that reuses a
+// blob while CollectBlobs is running.
+type reusingStore struct {
+	*blobs.LocalStore
+	reuse []string
+}
+
+func (s *reusingStore) List(fn func(info *blobs.BlobInfo) error) error {
+	if err := s.LocalStore.List(fn); err != nil {
+		return err
+	}
+	for _, key := range s.reuse {
+		data, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newBlobTestRepository(t *testing.T) (*SaveRepository, *reusingStore) {
+	r := newTestRepository(t)
+	local, err := blobs.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &reusingStore{LocalStore: local}
+	r.SetBlobStore(store, 16)
+	return r, store
+}
+
+// blobKey returns the blob key of the save in the slot.
+func blobKey(t *testing.T, r *SaveRepository, slot uint8) string {
+	t.Helper()
+	save := &types.UserGameSave{}
+	if err := r.db.Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", "alice", "game", slot).First(save).Error; err != nil {
+		t.Fatal(err)
+	}
+	if save.BlobKey == nil {
+		t.Fatalf("save in slot %d isn't in the blob store", slot)
+	}
+	return *save.BlobKey
+}
+
+func exists(t *testing.T, store blobs.BlobStore, key string) bool {
+	t.Helper()
+	_, err := store.Stat(key)
+	if err != nil && !errors.Is(err, blobs.ErrNotFound) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestBlobSaves(t *testing.T) {
+	r, store := newBlobTestRepository(t)
+	if _, err := r.PutSave("alice", "game", 1, "tiny", 0); err != nil {
+		t.Fatal(err)
+	}
+	save := &types.UserGameSave{}
+	if err := r.db.Where("save_slot = ?", 1).First(save).Error; err != nil {
+		t.Fatal(err)
+	}
+	if save.BlobKey != nil {
+		t.Error("a save below the threshold was moved to the blob store")
+	}
+
+	data := randomData(100)
+	if _, err := r.PutSave("alice", "game", 2, data, 0); err != nil {
+		t.Fatal(err)
+	}
+	key := blobKey(t, r, 2)
+	if !exists(t, store, key) {
+		t.Fatal("blob wasn't stored")
+	}
+	if got, err := r.GetSave("alice", "game", 2); err != nil || got.SaveData != data {
+		t.Errorf("GetSave = %v, %v", got, err)
+	}
+
+	r.SetBlobStore(nil, 0)
+	if _, err := r.GetSave("alice", "game", 2); !errors.Is(err, ErrNoBlobStore) {
+		t.Errorf("GetSave without a blob store = %v, want ErrNoBlobStore", err)
+	}
+}
+
+func TestCollectBlobs(t *testing.T) {
+	r, store := newBlobTestRepository(t)
+	r.SetRetention(1, 0)
+	put := func(slot uint8, data string) string {
+		t.Helper()
+		if _, err := r.ForcePut("alice", "game", slot, data); err != nil {
+			t.Fatal(err)
+		}
+		return blobKey(t, r, slot)
+	}
+
+	first := put(1, randomData(100))
+	second := put(1, randomData(100))  // first is now only referenced by a revision
+	current := put(1, randomData(100)) // first is pruned, second is a revision
+	other := put(2, randomData(100))
+	if err := r.DeleteSave("alice", "game", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Where("blob_key = ?", other).Delete(&types.UserGameSaveRevision{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is younger than the grace period.
+	if count, err := r.CollectBlobs(time.Hour); err != nil || count != 0 {
+		t.Errorf("CollectBlobs within the grace period = %d, %v, want 0", count, err)
+	}
+
+	// other is unreferenced, but is reused by a write while the collector runs.
+	store.reuse = []string{other}
+	count, err := r.CollectBlobs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("CollectBlobs = %d, want 1", count)
+	}
+	for _, test := range []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"pruned", first, false},
+		{"revision", second, true},
+		{"current", current, true},
+		{"reused", other, true},
+	} {
+		if got := exists(t, store, test.key); got != test.want {
+			t.Errorf("%s blob exists = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// A restore moves the blob from the revisions to the saves, and it stays referenced.
+	revisions, err := r.ListRevisions("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RestoreRevision("alice", revisions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	store.reuse = nil
+	if _, err := r.CollectBlobs(0); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(t, store, second) || !exists(t, store, current) {
+		t.Error("a blob was collected after a restore")
+	}
+	if exists(t, store, other) {
+		t.Error("an unreferenced blob wasn't collected")
+	}
+}
+
+func TestExportSaves(t *testing.T) {
+	r, _ := newBlobTestRepository(t)
+	large := strings.Repeat("x", 10) + randomData(100)
+	for i, data := range []string{"small", large} {
+		if _, err := r.PutSave("alice", "game", 1, data, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.db.Model(&types.User{}).Where("id = ?", "alice").Update("deleted_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	saves, revisions, err := r.ExportSaves("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saves) != 1 || saves[0].SaveData != large {
+		t.Errorf("exported saves = %d, want the large save", len(saves))
+	}
+	if len(revisions) != 1 || revisions[0].SaveData != "small" {
+		t.Errorf("exported revisions = %+v, want the small save", revisions)
+	}
+	if _, _, err := r.ExportSaves("missing"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ExportSaves for a missing user = %v, want ErrUserNotFound", err)
+	}
+}
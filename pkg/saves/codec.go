@@ -0,0 +1,99 @@
+package saves
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Save data is compressed before it is encrypted. The codec used is stored alongside it in
+// UserGameSave.Codec, since encrypted data can't be inspected. Saves written before
+// compression was introduced have CodecNone.
+const (
+	CodecNone uint8 = iota
+	CodecGzip
+	CodecZstd
+)
+
+// DefaultCodec is used until SetCodec is called.
+const DefaultCodec = CodecZstd
+
+var (
+	ErrCorruptSave  = errors.New("save data is corrupt")
+	ErrUnknownCodec = errors.New("unknown save codec")
+)
+
+// The zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll, and
+// expensive to create, so they are shared.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// SetCodec changes the codec new saves are compressed with. Existing saves keep theirs.
+func (r *SaveRepository) SetCodec(codec uint8) error {
+	if codec > CodecZstd {
+		return ErrUnknownCodec
+	}
+	r.codec = codec
+	return nil
+}
+
+// EncodeSaveData compresses data with codec if that makes it smaller, and returns the result
+// along with the codec that was actually used.
+func EncodeSaveData(data string, codec uint8) (string, uint8, error) {
+	var encoded []byte
+	switch codec {
+	case CodecNone:
+		return data, CodecNone, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write([]byte(data)); err != nil {
+			return "", 0, err
+		}
+		if err := writer.Close(); err != nil {
+			return "", 0, err
+		}
+		encoded = buf.Bytes()
+	case CodecZstd:
+		encoded = zstdEncoder.EncodeAll([]byte(data), nil)
+	default:
+		return "", 0, ErrUnknownCodec
+	}
+
+	if len(encoded) >= len(data) {
+		return data, CodecNone, nil
+	}
+	return string(encoded), codec, nil
+}
+
+// DecodeSaveData reverses EncodeSaveData on decrypted save data.
+func DecodeSaveData(data string, codec uint8) (string, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader([]byte(data)))
+		if err != nil {
+			return "", ErrCorruptSave
+		}
+		defer reader.Close()
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			return "", ErrCorruptSave
+		}
+		return string(decoded), nil
+	case CodecZstd:
+		decoded, err := zstdDecoder.DecodeAll([]byte(data), nil)
+		if err != nil {
+			return "", ErrCorruptSave
+		}
+		return string(decoded), nil
+	default:
+		return "", ErrUnknownCodec
+	}
+}
@@ -0,0 +1,129 @@
+package saves
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func TestSaveDataRoundTrip(t *testing.T) {
+	compressible := strings.Repeat(`{"level":1,"coins":250}`, 100)
+	incompressible := randomData(512)
+
+	tests := []struct {
+		name  string
+		data  string
+		codec uint8
+		want  uint8 // the codec actually used
+	}{
+		{"empty", "", CodecZstd, CodecNone},
+		{"none", compressible, CodecNone, CodecNone},
+		{"gzip", compressible, CodecGzip, CodecGzip},
+		{"zstd", compressible, CodecZstd, CodecZstd},
+		{"gzip, incompressible", incompressible, CodecGzip, CodecNone},
+		{"zstd, incompressible", incompressible, CodecZstd, CodecNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, codec, err := EncodeSaveData(test.data, test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec != test.want {
+				t.Errorf("encoded with codec %d, want %d", codec, test.want)
+			}
+			if codec != CodecNone && len(encoded) >= len(test.data) {
+				t.Errorf("encoded %d bytes into %d", len(test.data), len(encoded))
+			}
+			decoded, err := DecodeSaveData(encoded, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded != test.data {
+				t.Error("decoded data differs from the original")
+			}
+		})
+	}
+}
+
+func TestReadLegacySaves(t *testing.T) {
+	r := newTestRepository(t)
+	// Saves from before compression are stored as encrypted text with the default codec.
+	// These start with the bytes a marker would have used.
+	for slot, data := range map[uint8]string{1: "legacy text", 2: "\x00legacy", 3: "\x01\x02legacy"} {
+		save := &types.UserGameSave{UserID: "alice", DeveloperGameID: "game", SaveSlot: slot, SaveData: "enc:" + data}
+		if err := r.db.Omit("codec").Create(save).Error; err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.GetSave("alice", "game", slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Codec != CodecNone || got.SaveData != data {
+			t.Errorf("slot %d: read %q with codec %d, want %q with CodecNone", slot, got.SaveData, got.Codec, data)
+		}
+	}
+}
+
+func TestDecodeSaveDataErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		codec uint8
+		want  error
+	}{
+		{"corrupt gzip", "not gzip", CodecGzip, ErrCorruptSave},
+		{"corrupt zstd", "not zstd", CodecZstd, ErrCorruptSave},
+		{"unknown codec", "data", 99, ErrUnknownCodec},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeSaveData(test.data, test.codec); !errors.Is(err, test.want) {
+				t.Errorf("DecodeSaveData = %v, want %v", err, test.want)
+			}
+		})
+	}
+	if _, _, err := EncodeSaveData("data", 99); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("EncodeSaveData with an unknown codec = %v, want ErrUnknownCodec", err)
+	}
+}
+
+func TestSetCodec(t *testing.T) {
+	r := newTestRepository(t)
+	data := strings.Repeat("save data ", 100)
+	for _, codec := range []uint8{CodecNone, CodecGzip, CodecZstd} {
+		if err := r.SetCodec(codec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ForcePut("alice", "game", 1, data); err != nil {
+			t.Fatal(err)
+		}
+		save, err := r.GetSave("alice", "game", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if save.Codec != codec || save.SaveData != data {
+			t.Errorf("save written with codec %d has codec %d and %d bytes", codec, save.Codec, len(save.SaveData))
+		}
+	}
+
+	// Revisions keep the codec they were written with.
+	revisions, err := r.ListRevisions("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, revision := range revisions {
+		if _, err := r.RestoreRevision("alice", revision.ID); err != nil {
+			t.Fatal(err)
+		}
+		if save, err := r.GetSave("alice", "game", 1); err != nil || save.SaveData != data {
+			t.Errorf("restoring revision %d: %v", revision.Revision, err)
+		}
+	}
+
+	if err := r.SetCodec(99); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("SetCodec(99) = %v, want ErrUnknownCodec", err)
+	}
+}
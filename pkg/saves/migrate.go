@@ -0,0 +1,102 @@
+package saves
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+)
+
+// MigrateLegacySaves rebuilds the user_game_saves table if SaveSlot isn't part of its primary
+// key yet, which limited users to one save per game. Every existing row is carried over; rows
+// without a valid slot are moved to the first one, which is free since each user could only
+// hold one save per game. The rows are copied into the new table by the database itself, and
+// the old table is only dropped once the new one is in place.
+// It must run before AutoMigrate, which leaves the existing primary key alone. Columns the old
+// table doesn't have yet get their defaults.
+func MigrateLegacySaves(db *gorm.DB) error {
+	if !dbutil.RebuildPending(db, &types.UserGameSave{}) {
+		migrator := db.Migrator()
+		if !migrator.HasTable(&types.UserGameSave{}) {
+			return nil
+		}
+		columns, err := migrator.ColumnTypes(&types.UserGameSave{})
+		if err != nil {
+			return err
+		}
+		for _, column := range columns {
+			if column.Name() != "save_slot" {
+				continue
+			}
+			if primaryKey, ok := column.PrimaryKey(); !ok || primaryKey {
+				return nil
+			}
+		}
+	}
+
+	var count int64
+	if err := dbutil.RebuildTable(db, &types.UserGameSave{}, func(tx *gorm.DB, from string, to string) error {
+		existing, err := tx.Migrator().ColumnTypes(from)
+		if err != nil {
+			return err
+		}
+		has := map[string]bool{}
+		for _, column := range existing {
+			has[column.Name()] = true
+		}
+
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(&types.UserGameSave{}); err != nil {
+			return err
+		}
+		var columns, values []string
+		for _, name := range stmt.Schema.DBNames {
+			switch {
+			case name == "save_slot":
+				columns = append(columns, stmt.Quote(name))
+				if has[name] {
+					values = append(values, fmt.Sprintf("CASE WHEN %[1]s < %[2]d THEN %[2]d ELSE %[1]s END", stmt.Quote(name), types.SaveSlotMin))
+				} else {
+					values = append(values, strconv.Itoa(types.SaveSlotMin))
+				}
+			case has[name]:
+				columns = append(columns, stmt.Quote(name))
+				values = append(values, stmt.Quote(name))
+			}
+		}
+
+		result := tx.Exec("INSERT INTO " + stmt.Quote(to) + " (" + strings.Join(columns, ", ") + ") " +
+			"SELECT " + strings.Join(values, ", ") + " FROM " + stmt.Quote(from))
+		count = result.RowsAffected
+		return result.Error
+	}); err != nil {
+		return err
+	}
+
+	log.Info("Rebuilt save table with ", count, " saves.")
+	return nil
+}
+
+// MigrateSaveSlotLimits raises the MaxSaveSlots of games whose existing saves use higher
+// slots, such as those carried over by MigrateLegacySaves, so that they stay writable. It
+// must run after AutoMigrate.
+func MigrateSaveSlotLimits(db *gorm.DB) error {
+	highest := db.Model(&types.UserGameSave{}).
+		Select("MAX(save_slot)").
+		Where("developer_game_id = developer_games.id")
+	return db.Model(&types.DeveloperGame{}).
+		Where("max_save_slots < (?)", highest).
+		Update("max_save_slots", gorm.Expr("(?)", highest)).Error
+}
+
+// MigrateStoredSizes fills in StoredSize for saves written before quotas were introduced, so
+// that they count towards them.
+func MigrateStoredSizes(db *gorm.DB) error {
+	return db.Model(&types.UserGameSave{}).
+		Where("stored_size = 0 AND save_data <> ''").
+		UpdateColumn("stored_size", gorm.Expr("LENGTH(save_data)")).Error
+}
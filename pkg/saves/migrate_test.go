@@ -0,0 +1,132 @@
+package saves
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// legacySave mirrors the user_game_saves table from before SaveSlot was part of the key.
+type legacySave struct {
+	UserID          string `gorm:"primaryKey"`
+	DeveloperGameID string `gorm:"primaryKey"`
+	SaveSlot        uint8
+	SaveData        string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (legacySave) TableName() string {
+	return "user_game_saves"
+}
+
+func TestMigrateLegacySaves(t *testing.T) {
+	db := dbtest.Open(t, &legacySave{}, &types.DeveloperGame{})
+	legacy := []*legacySave{
+		{UserID: "alice", DeveloperGameID: "game", SaveSlot: 0, SaveData: "a"},
+		{UserID: "bob", DeveloperGameID: "game", SaveSlot: 12, SaveData: "b"},
+		{UserID: "alice", DeveloperGameID: "other", SaveSlot: 3, SaveData: "c"},
+	}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"game", "other"} {
+		if err := db.Create(&types.DeveloperGame{ID: id, MaxSaveSlots: 10}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateLegacySaves(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&types.UserGameSave{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateSaveSlotLimits(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var saves []*types.UserGameSave
+	if err := db.Order("user_id, developer_game_id").Find(&saves).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		userID string
+		gameID string
+		slot   uint8
+		data   string
+	}{
+		{"alice", "game", types.SaveSlotMin, "a"},
+		{"alice", "other", 3, "c"},
+		{"bob", "game", 12, "b"},
+	}
+	if len(saves) != len(want) {
+		t.Fatalf("migrated %d saves, want %d", len(saves), len(want))
+	}
+	for i, save := range saves {
+		w := want[i]
+		if save.UserID != w.userID || save.DeveloperGameID != w.gameID || save.SaveSlot != w.slot || save.SaveData != w.data || save.Revision != 1 {
+			t.Errorf("save %d = %+v, want %+v", i, save, w)
+		}
+	}
+
+	// A second slot for the same game now fits next to the first.
+	second := &types.UserGameSave{UserID: "alice", DeveloperGameID: "game", SaveSlot: 2, SaveData: "d"}
+	if err := db.Create(second).Error; err != nil {
+		t.Errorf("creating a second slot: %v", err)
+	}
+	if !db.Migrator().HasIndex(&types.UserGameSave{}, "idx_user_game_saves_blob_key") {
+		t.Error("index idx_user_game_saves_blob_key is missing")
+	}
+
+	games := map[string]uint8{}
+	var rows []*types.DeveloperGame
+	if err := db.Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, game := range rows {
+		games[game.ID] = game.MaxSaveSlots
+	}
+	if games["game"] != 12 || games["other"] != 10 {
+		t.Errorf("MaxSaveSlots = %v, want game: 12, other: 10", games)
+	}
+
+	// Running it again does nothing.
+	if err := MigrateLegacySaves(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := db.Model(&types.UserGameSave{}).Count(&count).Error; err != nil || count != 4 {
+		t.Errorf("after a second run: %d saves, %v, want 4", count, err)
+	}
+}
+
+func TestMigrateStoredSizes(t *testing.T) {
+	r := newTestRepository(t)
+	insert := r.db.Session(&gorm.Session{SkipHooks: true})
+	saves := []*types.UserGameSave{
+		{UserID: "alice", DeveloperGameID: "game", SaveSlot: 1, SaveData: "legacy data"},
+		{UserID: "alice", DeveloperGameID: "game", SaveSlot: 2, SaveData: "counted", StoredSize: 99},
+		{UserID: "alice", DeveloperGameID: "game", SaveSlot: 3},
+	}
+	if err := insert.Create(&saves).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateStoredSizes(r.db); err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint8]uint32{1: uint32(len("legacy data")), 2: 99, 3: 0}
+	var migrated []*types.UserGameSave
+	if err := r.db.Find(&migrated).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, save := range migrated {
+		if save.StoredSize != want[save.SaveSlot] {
+			t.Errorf("slot %d has a stored size of %d, want %d", save.SaveSlot, save.StoredSize, want[save.SaveSlot])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package saves
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// Quotas limit how much storage saves may take up, measured in stored (compressed and
+// encrypted) bytes. Revisions don't count towards them. Zero disables a limit.
+type Quotas struct {
+	// PerSave limits the size of a single save.
+	PerSave int64
+
+	// PerGame limits the total size of a user's saves for one game. Games can override it
+	// with DeveloperGame.SaveQuota.
+	PerGame int64
+
+	// PerUser limits the total size of a user's saves across all games.
+	PerUser int64
+}
+
+// DefaultQuotas is used until SetQuotas is called.
+var DefaultQuotas = Quotas{
+	PerSave: 1 << 20,
+	PerGame: 10 << 20,
+	PerUser: 100 << 20,
+}
+
+// QuotaError is returned when a write would exceed a quota.
+type QuotaError struct {
+	Scope string // "save", "game" or "user"
+	Limit int64
+	Used  int64 // Including the rejected write
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d of %d bytes", e.Scope, e.Used, e.Limit)
+}
+
+// ErrQuotaExceeded can be used with errors.Is to check for a QuotaError.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Usage sums up the saves of a user or game.
+type Usage struct {
+	Saves      int64 `json:"saves"`
+	Size       int64 `json:"size"`        // Unencrypted and uncompressed bytes
+	StoredSize int64 `json:"stored_size"` // Bytes counted towards quotas
+}
+
+// SetQuotas changes the storage quotas. Negative values are treated as zero.
+func (r *SaveRepository) SetQuotas(quotas Quotas) {
+	r.quotas = Quotas{
+		PerSave: max(quotas.PerSave, 0),
+		PerGame: max(quotas.PerGame, 0),
+		PerUser: max(quotas.PerUser, 0),
+	}
+}
+
+// UserUsage returns how much storage the user's saves take up across all games.
+func (r *SaveRepository) UserUsage(userID string) (*Usage, error) {
+	return usage(r.db.Where("user_id = ?", userID))
+}
+
+// GameUsage returns how much storage all users' saves for a game take up.
+func (r *SaveRepository) GameUsage(gameID string) (*Usage, error) {
+	return usage(r.db.Where("developer_game_id = ?", gameID))
+}
+
+// UserGameUsage returns how much storage the user's saves for one game take up.
+func (r *SaveRepository) UserGameUsage(userID string, gameID string) (*Usage, error) {
+	return usage(r.db.Where("user_id = ? AND developer_game_id = ?", userID, gameID))
+}
+
+func usage(query *gorm.DB) (*Usage, error) {
+	result := &Usage{}
+	err := query.Model(&types.UserGameSave{}).
+		Select("COUNT(*) AS saves, COALESCE(SUM(size), 0) AS size, COALESCE(SUM(stored_size), 0) AS stored_size").
+		Scan(result).Error
+	return result, err
+}
+
+// checkQuotas returns a QuotaError if storing save would exceed a quota. The slot's current
+// save is left out, since it gets replaced.
+func (r *SaveRepository) checkQuotas(tx *gorm.DB, save *types.UserGameSave) error {
+	stored := int64(save.StoredSize)
+	if r.quotas.PerSave > 0 && stored > r.quotas.PerSave {
+		return &QuotaError{Scope: "save", Limit: r.quotas.PerSave, Used: stored}
+	}
+
+	if r.quotas.PerUser > 0 {
+		used, err := usage(tx.Where("user_id = ? AND NOT (developer_game_id = ? AND save_slot = ?)", save.UserID, save.DeveloperGameID, save.SaveSlot))
+		if err != nil {
+			return err
+		}
+		if total := used.StoredSize + stored; total > r.quotas.PerUser {
+			return &QuotaError{Scope: "user", Limit: r.quotas.PerUser, Used: total}
+		}
+	}
+
+	limit := r.quotas.PerGame
+	var overrides []int64
+	if err := tx.Model(&types.DeveloperGame{}).Where("id = ?", save.DeveloperGameID).Pluck("save_quota", &overrides).Error; err != nil {
+		return err
+	}
+	if len(overrides) > 0 && overrides[0] > 0 {
+		limit = overrides[0]
+	}
+	if limit > 0 {
+		used, err := usage(tx.Where("user_id = ? AND developer_game_id = ? AND save_slot <> ?", save.UserID, save.DeveloperGameID, save.SaveSlot))
+		if err != nil {
+			return err
+		}
+		if total := used.StoredSize + stored; total > limit {
+			return &QuotaError{Scope: "game", Limit: limit, Used: total}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package saves
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// DefaultRevisionsKept is how many previous versions of each save slot are kept.
+const DefaultRevisionsKept = 5
+
+// DefaultRevisionMaxAge is how long a revision is kept before PruneRevisions deletes it.
+const DefaultRevisionMaxAge = 30 * 24 * time.Hour
+
+// maxStaleRevisions bounds how many stale revisions are deleted per write. MySQL doesn't
+// accept an OFFSET without a LIMIT, and normally there is only one anyway.
+const maxStaleRevisions = 1000
+
+var ErrRevisionNotFound = errors.New("save revision not found")
+
+// SetRetention changes how many revisions are kept per save slot and how old they may get.
+// A keep of zero disables revisions, and a maxAge of zero keeps them regardless of age.
+func (r *SaveRepository) SetRetention(keep int, maxAge time.Duration) {
+	if keep < 0 {
+		keep = 0
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	r.keepRevisions = keep
+	r.revisionMaxAge = maxAge
+}
+
+// ListRevisions returns the previous versions of a save slot, newest first, without their data.
+func (r *SaveRepository) ListRevisions(userID string, gameID string, slot uint8) ([]*types.UserGameSaveRevision, error) {
+	var revisions []*types.UserGameSaveRevision
+	err := r.db.Omit("save_data").
+		Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", userID, gameID, slot).
+		Order("created_at DESC, id DESC").
+		Find(&revisions).Error
+	return revisions, err
+}
+
+// RestoreRevision makes a revision the current save of its slot again, and returns the save's
+// new revision. The save it replaces is kept as a revision in turn, so a restore can be undone.
+// Like ForcePut, it overwrites the slot regardless of its revision, but quotas still apply.
+func (r *SaveRepository) RestoreRevision(userID string, revisionID string) (uint64, error) {
+	save := &types.UserGameSave{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		revision := &types.UserGameSaveRevision{}
+		if err := tx.Where("id = ? AND user_id = ?", revisionID, userID).First(revision).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRevisionNotFound
+			}
+			return err
+		}
+
+		// The restored version becomes the current save, so it doesn't need to stay a revision.
+		if err := tx.Delete(revision).Error; err != nil {
+			return err
+		}
+
+		current, err := lockSave(tx, userID, revision.DeveloperGameID, revision.SaveSlot)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			if err := r.archive(tx, current); err != nil {
+				return err
+			}
+		}
+
+		save = &types.UserGameSave{
+			UserID:          userID,
+			DeveloperGameID: revision.DeveloperGameID,
+			SaveSlot:        revision.SaveSlot,
+			SaveData:        revision.SaveData,
+			KeyVersion:      revision.KeyVersion,
+			Size:            revision.Size,
+			StoredSize:      revision.StoredSize,
+			Codec:           revision.Codec,
+			BlobKey:         revision.BlobKey,
+			Revision:        revision.Revision,
+		}
+		if err := r.checkQuotas(tx, save); err != nil {
+			return err
+		}
+		if err := writeSave(tx, current, save); err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "game_save_restored", revision.ID, true)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return save.Revision, nil
+}
+
+// PruneRevisions deletes revisions older than the retention's max age.
+func (r *SaveRepository) PruneRevisions() (int64, error) {
+	if r.revisionMaxAge <= 0 {
+		return 0, nil
+	}
+	result := r.db.Where("created_at < ?", time.Now().Add(-r.revisionMaxAge)).Delete(&types.UserGameSaveRevision{})
+	return result.RowsAffected, result.Error
+}
+
+// StartRevisionPruner runs PruneRevisions every interval in the background until the returned
+// function is called.
+func (r *SaveRepository) StartRevisionPruner(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count, err := r.PruneRevisions()
+				if err != nil {
+					log.Error("Failed to prune save revisions: ", err)
+					continue
+				}
+				if count > 0 {
+					log.Debug("Pruned ", count, " save revisions.")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// archive keeps a copy of the save as a revision and deletes the slot's revisions beyond
+// keepRevisions.
+func (r *SaveRepository) archive(tx *gorm.DB, save *types.UserGameSave) error {
+	if r.keepRevisions <= 0 {
+		return nil
+	}
+	if err := tx.Create(&types.UserGameSaveRevision{
+		ID:              ulid.Make().String(),
+		UserID:          save.UserID,
+		DeveloperGameID: save.DeveloperGameID,
+		SaveSlot:        save.SaveSlot,
+		SaveData:        save.SaveData,
+		KeyVersion:      save.KeyVersion,
+		Size:            save.Size,
+		StoredSize:      save.StoredSize,
+		Codec:           save.Codec,
+		BlobKey:         save.BlobKey,
+		Revision:        save.Revision,
+		SavedAt:         save.UpdatedAt,
+	}).Error; err != nil {
+		return err
+	}
+
+	var stale []string
+	if err := tx.Model(&types.UserGameSaveRevision{}).
+		Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", save.UserID, save.DeveloperGameID, save.SaveSlot).
+		Order("created_at DESC, id DESC").
+		Offset(r.keepRevisions).
+		Limit(maxStaleRevisions).
+		Pluck("id", &stale).Error; err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return tx.Where("id IN ?", stale).Delete(&types.UserGameSaveRevision{}).Error
+}
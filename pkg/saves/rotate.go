@@ -0,0 +1,146 @@
+package saves
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rotationBatchSize is how many users are loaded at a time during a bulk rotation.
+const rotationBatchSize = 100
+
+var ErrUserNotFound = errors.New("user not found")
+
+// RotateUserSecret gives the user a new secret and re-encrypts all of their saves and save
+// revisions with it. keyVersion is the version of the master key the cipher currently creates
+// secrets under, and is recorded on the user and their saves. Everything happens in one
+// transaction, so a failure leaves the old secret and saves intact. Soft-deleted users are
+// rotated too, since their saves come back if they are restored.
+func (r *SaveRepository) RotateUserSecret(userID string, keyVersion uint16) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		user := &types.User{}
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", userID).First(user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		secret, err := r.cipher.CreateUserSecret()
+		if err != nil {
+			return err
+		}
+		rotated := *user
+		rotated.Secret = secret
+		rotated.SecretVersion = keyVersion
+
+		var saves []*types.UserGameSave
+		if err := tx.Where("user_id = ?", user.ID).Find(&saves).Error; err != nil {
+			return err
+		}
+		for _, save := range saves {
+			updates, err := r.reencrypt(user, &rotated, save.SaveData, save.BlobKey)
+			if err != nil {
+				return fmt.Errorf("re-encrypting save %s/%d: %w", save.DeveloperGameID, save.SaveSlot, err)
+			}
+			if err := tx.Model(save).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		var revisions []*types.UserGameSaveRevision
+		if err := tx.Where("user_id = ?", user.ID).Find(&revisions).Error; err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			updates, err := r.reencrypt(user, &rotated, revision.SaveData, revision.BlobKey)
+			if err != nil {
+				return fmt.Errorf("re-encrypting save revision %s: %w", revision.ID, err)
+			}
+			if err := tx.Model(revision).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Unscoped().Model(user).Updates(map[string]any{
+			"secret":         rotated.Secret,
+			"secret_version": rotated.SecretVersion,
+		}).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, user.ID, "user_secret_rotated", fmt.Sprintf("%d saves, key version %d", len(saves), rotated.SecretVersion), true)
+	})
+
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		if logErr := dbutil.LogUserEvent(r.db, userID, "user_secret_rotation_failure", "", false); logErr != nil {
+			return logErr
+		}
+	}
+	return err
+}
+
+// reencrypt decrypts save data with the old user's secret and encrypts it with the rotated
+// user's, returning the columns to update. Data in the blob store is written to a new blob;
+// the old one is left to the garbage collector, so that a rollback doesn't lose it.
+func (r *SaveRepository) reencrypt(old *types.User, rotated *types.User, saveData string, blobKey *string) (map[string]any, error) {
+	encrypted, err := r.loadData(saveData, blobKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.cipher.Decrypt(old, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted, err = r.cipher.Encrypt(rotated, data); err != nil {
+		return nil, err
+	}
+	storedSize := len(encrypted)
+	if saveData, blobKey, err = r.storeData(encrypted); err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"save_data":   saveData,
+		"blob_key":    blobKey,
+		"key_version": rotated.SecretVersion,
+		"stored_size": storedSize,
+	}, nil
+}
+
+// RotateAllSecrets rotates the secret of every user whose secret predates keyVersion, e.g.
+// after a master key was compromised. Each user is rotated in their own
+// transaction; failures are logged and skipped so that one bad save doesn't hold up everyone
+// else. It returns the number of users rotated and the number that failed.
+func (r *SaveRepository) RotateAllSecrets(keyVersion uint16) (rotated int, failed int, err error) {
+	lastID := ""
+	for {
+		var ids []string
+		if err := r.db.Unscoped().Model(&types.User{}).
+			Where("secret_version < ? AND id > ?", keyVersion, lastID).
+			Order("id").
+			Limit(rotationBatchSize).
+			Pluck("id", &ids).Error; err != nil {
+			return rotated, failed, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		lastID = ids[len(ids)-1]
+
+		for _, id := range ids {
+			if err := r.RotateUserSecret(id, keyVersion); err != nil {
+				log.Error("Failed to rotate secret for user ", id, ": ", err)
+				failed++
+				continue
+			}
+			rotated++
+		}
+	}
+
+	log.Info("Rotated secrets for ", rotated, " users to key version ", keyVersion, " (", failed, " failed).")
+	return rotated, failed, nil
+}
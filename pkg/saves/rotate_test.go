@@ -0,0 +1,85 @@
+package saves
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+// secretCipher "encrypts" by prefixing data with the user's secret, so that data only
+// decrypts with the secret it was written under.
+type secretCipher struct {
+	secrets *int
+}
+
+func (c secretCipher) CreateUserSecret() (string, error) {
+	*c.secrets++
+	return "secret" + strconv.Itoa(*c.secrets), nil
+}
+
+func (secretCipher) Encrypt(user *types.User, data string) (string, error) {
+	return user.Secret + ":" + data, nil
+}
+
+func (secretCipher) Decrypt(user *types.User, data string) (string, error) {
+	if !strings.HasPrefix(data, user.Secret+":") {
+		return "", errors.New("wrong secret")
+	}
+	return strings.TrimPrefix(data, user.Secret+":"), nil
+}
+
+func TestRotateAllSecrets(t *testing.T) {
+	r := newTestRepository(t)
+	r = NewSaveRepository(r.db, secretCipher{new(int)})
+	if err := r.db.Model(&types.User{}).Where("1 = 1").Update("secret", "secret0").Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{"alice", "bob"} {
+		if _, err := r.PutSave(userID, "game", 1, "one", 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.PutSave(userID, "game", 1, "two", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.db.Delete(&types.User{ID: "bob"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, failed, err := r.RotateAllSecrets(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 || failed != 0 {
+		t.Fatalf("RotateAllSecrets = %d rotated, %d failed, want 2 and 0", rotated, failed)
+	}
+
+	for _, userID := range []string{"alice", "bob"} {
+		user := &types.User{}
+		if err := r.db.Unscoped().Where("id = ?", userID).First(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		if user.Secret == "secret0" || user.SecretVersion != 1 {
+			t.Errorf("%s has secret %q version %d, want a new one at version 1", userID, user.Secret, user.SecretVersion)
+		}
+
+		saves, revisions, err := r.ExportSaves(userID)
+		if err != nil {
+			t.Fatalf("reading %s's saves after rotation: %v", userID, err)
+		}
+		if len(saves) != 1 || saves[0].SaveData != "two" || saves[0].KeyVersion != 1 {
+			t.Errorf("%s's saves = %+v", userID, saves)
+		}
+		if len(revisions) != 1 || revisions[0].SaveData != "one" || revisions[0].KeyVersion != 1 {
+			t.Errorf("%s's revisions = %+v", userID, revisions)
+		}
+	}
+
+	// Everyone is up to date, so there is nothing left to rotate.
+	if rotated, _, err := r.RotateAllSecrets(1); rotated != 0 || err != nil {
+		t.Errorf("second RotateAllSecrets = %d, %v, want 0", rotated, err)
+	}
+}
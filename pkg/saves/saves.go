@@ -0,0 +1,327 @@
+// Package saves stores users' game saves, their revisions and quotas.
+//
+// Save data is compressed, then encrypted with the user's secret. The codec is recorded in
+// the Codec column of UserGameSave and UserGameSaveRevision rather than in a marker byte
+// at the start of the data, for two reasons: the data is encrypted, so a marker could only
+// be read after decrypting; and saves from before compression are uncompressed text that
+// may itself start with any byte, so a marker couldn't tell them apart reliably. Those saves
+// have CodecNone, the column default. Both gzip and zstd are supported, with zstd used for
+// new saves by default.
+package saves
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/blobs"
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrSaveNotFound = errors.New("save not found")
+	ErrGameNotFound = errors.New("game not found")
+	ErrSlotsInUse   = errors.New("saves exist in slots beyond the new limit")
+	ErrConflict     = errors.New("save was changed by another write")
+)
+
+// SaveCipher encrypts save data with a user's secret. The accounts database implements it,
+// since it owns the encryption scheme and the master key that protects the user secrets.
+type SaveCipher interface {
+	// CreateUserSecret generates a new secret under the current master key.
+	CreateUserSecret() (string, error)
+
+	Encrypt(user *types.User, data string) (string, error)
+	Decrypt(user *types.User, data string) (string, error)
+}
+
+// SaveRepository stores users' game saves.
+type SaveRepository struct {
+	db             *gorm.DB
+	cipher         SaveCipher
+	keepRevisions  int
+	revisionMaxAge time.Duration
+	quotas         Quotas
+	blobs          blobs.BlobStore
+	blobThreshold  int
+	codec          uint8
+}
+
+func NewSaveRepository(db *gorm.DB, cipher SaveCipher) *SaveRepository {
+	if db == nil {
+		panic("Got nil database")
+	}
+	return &SaveRepository{
+		db:             db,
+		cipher:         cipher,
+		keepRevisions:  DefaultRevisionsKept,
+		revisionMaxAge: DefaultRevisionMaxAge,
+		quotas:         DefaultQuotas,
+		codec:          DefaultCodec,
+	}
+}
+
+// GetSave returns the save in the given slot, with SaveData decrypted.
+func (r *SaveRepository) GetSave(userID string, gameID string, slot uint8) (*types.UserGameSave, error) {
+	user, err := r.getUser(r.db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	save := &types.UserGameSave{}
+	if err := r.db.Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", userID, gameID, slot).First(save).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSaveNotFound
+		}
+		return nil, err
+	}
+	if save.SaveData, err = r.decrypt(user, save.SaveData, save.BlobKey, save.Codec); err != nil {
+		return nil, err
+	}
+	return save, nil
+}
+
+// ExportSaves returns all of the user's saves and save revisions with their data decrypted,
+// for data exports. Unlike the other methods, it includes soft-deleted users.
+func (r *SaveRepository) ExportSaves(userID string) ([]*types.UserGameSave, []*types.UserGameSaveRevision, error) {
+	user, err := r.getUser(r.db.Unscoped(), userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var saves []*types.UserGameSave
+	if err := r.db.Where("user_id = ?", userID).Order("developer_game_id, save_slot").Find(&saves).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, save := range saves {
+		if save.SaveData, err = r.decrypt(user, save.SaveData, save.BlobKey, save.Codec); err != nil {
+			return nil, nil, fmt.Errorf("decrypting save %s/%d: %w", save.DeveloperGameID, save.SaveSlot, err)
+		}
+	}
+
+	var revisions []*types.UserGameSaveRevision
+	if err := r.db.Where("user_id = ?", userID).Order("created_at, id").Find(&revisions).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, revision := range revisions {
+		if revision.SaveData, err = r.decrypt(user, revision.SaveData, revision.BlobKey, revision.Codec); err != nil {
+			return nil, nil, fmt.Errorf("decrypting save revision %s: %w", revision.ID, err)
+		}
+	}
+	return saves, revisions, nil
+}
+
+// ListSaves returns the user's saves for a game ordered by slot, without their data.
+func (r *SaveRepository) ListSaves(userID string, gameID string) ([]*types.UserGameSave, error) {
+	var saves []*types.UserGameSave
+	err := r.db.Omit("save_data").Where("user_id = ? AND developer_game_id = ?", userID, gameID).Order("save_slot").Find(&saves).Error
+	return saves, err
+}
+
+// PutSave compresses and encrypts data and stores it in the given slot, and returns the save's
+// new revision.
+// expectedRevision must be the revision the client last read, or zero if it expects the slot
+// to be empty; otherwise the write fails with ErrConflict, so that clients can tell the player
+// that the cloud save is newer. An existing save is kept as a revision. The slot must be
+// within the game's MaxSaveSlots, and the write fails with a QuotaError if it would exceed a
+// quota.
+func (r *SaveRepository) PutSave(userID string, gameID string, slot uint8, data string, expectedRevision uint64) (uint64, error) {
+	return r.put(userID, gameID, slot, data, &expectedRevision)
+}
+
+// ForcePut is like PutSave, but overwrites the slot regardless of its revision. It is meant for
+// when the player deliberately chose to replace the cloud save.
+func (r *SaveRepository) ForcePut(userID string, gameID string, slot uint8, data string) (uint64, error) {
+	return r.put(userID, gameID, slot, data, nil)
+}
+
+func (r *SaveRepository) put(userID string, gameID string, slot uint8, data string, expectedRevision *uint64) (uint64, error) {
+	encoded, codec, err := EncodeSaveData(data, r.codec)
+	if err != nil {
+		return 0, err
+	}
+	save := &types.UserGameSave{
+		UserID:          userID,
+		DeveloperGameID: gameID,
+		SaveSlot:        slot,
+		Size:            uint32(len(data)),
+		Codec:           codec,
+	}
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the user serializes their writes, so that concurrent ones can't each slip
+		// under a quota.
+		user, err := r.getUser(tx.Clauses(clause.Locking{Strength: "UPDATE"}), userID)
+		if err != nil {
+			return err
+		}
+		if save.SaveData, err = r.cipher.Encrypt(user, encoded); err != nil {
+			return err
+		}
+		save.KeyVersion = user.SecretVersion
+		save.StoredSize = uint32(len(save.SaveData))
+
+		current, err := lockSave(tx, userID, gameID, slot)
+		if err != nil {
+			return err
+		}
+		if expectedRevision != nil {
+			var revision uint64
+			if current != nil {
+				revision = current.Revision
+			}
+			if revision != *expectedRevision {
+				return ErrConflict
+			}
+		}
+		if err := r.checkQuotas(tx, save); err != nil {
+			return err
+		}
+		if save.SaveData, save.BlobKey, err = r.storeData(save.SaveData); err != nil {
+			return err
+		}
+		if current != nil {
+			if err := r.archive(tx, current); err != nil {
+				return err
+			}
+		}
+		return writeSave(tx, current, save)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return save.Revision, nil
+}
+
+// DeleteSave deletes the save in the given slot. It is kept as a revision, so it can still be
+// restored until the revision is pruned.
+func (r *SaveRepository) DeleteSave(userID string, gameID string, slot uint8) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockSave(tx, userID, gameID, slot)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrSaveNotFound
+		}
+		if err := r.archive(tx, current); err != nil {
+			return err
+		}
+		if err := tx.Delete(current).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "game_save_deleted", fmt.Sprintf("%s/%d", gameID, slot), true)
+	})
+}
+
+// SetMaxSaveSlots changes how many save slots each user gets for a game. It fails with
+// ErrSlotsInUse if lowering the limit would strand existing saves.
+func (r *SaveRepository) SetMaxSaveSlots(gameID string, slots uint8) error {
+	game := &types.DeveloperGame{MaxSaveSlots: slots}
+	if err := game.Validate(); err != nil {
+		return err
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", gameID).First(game).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrGameNotFound
+			}
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&types.UserGameSave{}).Where("developer_game_id = ? AND save_slot > ?", gameID, slots).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrSlotsInUse
+		}
+		return tx.Model(game).Update("max_save_slots", slots).Error
+	})
+}
+
+// lockSave locks and returns the save in the given slot, or nil if the slot is empty.
+func lockSave(tx *gorm.DB, userID string, gameID string, slot uint8) (*types.UserGameSave, error) {
+	var saves []*types.UserGameSave
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", userID, gameID, slot).
+		Limit(1).
+		Find(&saves).Error; err != nil {
+		return nil, err
+	}
+	if len(saves) == 0 {
+		return nil, nil
+	}
+	return saves[0], nil
+}
+
+// writeSave stores save in its slot and bumps its revision. current is the save being replaced,
+// or nil if the slot is empty. The write is guarded on the current revision, so a concurrent
+// write makes it fail with ErrConflict instead of being lost.
+// An empty slot continues after the highest revision archived for it, or after save.Revision
+// if that is higher, so that a client holding a revision of a deleted save can't overwrite a
+// new save that happens to reach the same number.
+func writeSave(tx *gorm.DB, current *types.UserGameSave, save *types.UserGameSave) error {
+	if current == nil {
+		var archived uint64
+		if err := tx.Model(&types.UserGameSaveRevision{}).
+			Where("user_id = ? AND developer_game_id = ? AND save_slot = ?", save.UserID, save.DeveloperGameID, save.SaveSlot).
+			Select("COALESCE(MAX(revision), 0)").
+			Scan(&archived).Error; err != nil {
+			return err
+		}
+		save.Revision = max(save.Revision, archived) + 1
+		if err := tx.Create(save).Error; err != nil {
+			if dbutil.IsUniqueViolation(err) {
+				return ErrConflict
+			}
+			return err
+		}
+		return nil
+	}
+
+	save.Revision = current.Revision + 1
+	result := tx.Model(current).Where("revision = ?", current.Revision).Updates(map[string]any{
+		"save_data":   save.SaveData,
+		"key_version": save.KeyVersion,
+		"size":        save.Size,
+		"stored_size": save.StoredSize,
+		"codec":       save.Codec,
+		"blob_key":    save.BlobKey,
+		"revision":    save.Revision,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// decrypt returns the plaintext of a save or revision, wherever its data is kept.
+func (r *SaveRepository) decrypt(user *types.User, saveData string, blobKey *string, codec uint8) (string, error) {
+	encrypted, err := r.loadData(saveData, blobKey)
+	if err != nil {
+		return "", err
+	}
+	data, err := r.cipher.Decrypt(user, encrypted)
+	if err != nil {
+		return "", err
+	}
+	return DecodeSaveData(data, codec)
+}
+
+func (r *SaveRepository) getUser(tx *gorm.DB, userID string) (*types.User, error) {
+	user := &types.User{}
+	if err := tx.Where("id = ?", userID).First(user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
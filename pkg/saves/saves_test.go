@@ -0,0 +1,252 @@
+package saves
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+// testCipher "encrypts" by prefixing data with a marker, which is enough to check that data
+// passes through it.
+type testCipher struct{}
+
+func (testCipher) CreateUserSecret() (string, error) {
+	return "secret", nil
+}
+
+func (testCipher) Encrypt(user *types.User, data string) (string, error) {
+	return "enc:" + data, nil
+}
+
+func (testCipher) Decrypt(user *types.User, data string) (string, error) {
+	if !strings.HasPrefix(data, "enc:") {
+		return "", errors.New("not encrypted")
+	}
+	return strings.TrimPrefix(data, "enc:"), nil
+}
+
+func newTestRepository(t *testing.T) *SaveRepository {
+	db := dbtest.Open(t, &types.User{}, &types.DeveloperGame{}, &types.UserGameSave{}, &types.UserGameSaveRevision{}, &types.UserEvent{})
+	for _, id := range []string{"alice", "bob"} {
+		if err := db.Create(&types.User{ID: id, Username: id, Email: id + "@example.com"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"game", "other"} {
+		if err := db.Create(&types.DeveloperGame{ID: id, MaxSaveSlots: 3}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewSaveRepository(db, testCipher{})
+}
+
+func TestRevisions(t *testing.T) {
+	r := newTestRepository(t)
+	for i, data := range []string{"one", "two", "three"} {
+		if _, err := r.PutSave("alice", "game", 1, data, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revisions, err := r.ListRevisions("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision != 2 || revisions[1].Revision != 1 {
+		t.Fatalf("revisions = %+v, want 2 and 1", revisions)
+	}
+
+	if _, err := r.RestoreRevision("bob", revisions[1].ID); !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("restoring another user's revision = %v, want ErrRevisionNotFound", err)
+	}
+	if _, err := r.RestoreRevision("alice", revisions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	save, err := r.GetSave("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if save.SaveData != "one" {
+		t.Errorf("restored save = %q, want %q", save.SaveData, "one")
+	}
+}
+
+func TestDeleteSave(t *testing.T) {
+	r := newTestRepository(t)
+	if err := r.DeleteSave("alice", "game", 1); !errors.Is(err, ErrSaveNotFound) {
+		t.Errorf("deleting an empty slot = %v, want ErrSaveNotFound", err)
+	}
+	if _, err := r.PutSave("alice", "game", 1, "data", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteSave("alice", "game", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetSave("alice", "game", 1); !errors.Is(err, ErrSaveNotFound) {
+		t.Errorf("GetSave after deleting = %v, want ErrSaveNotFound", err)
+	}
+
+	var events []*types.UserEvent
+	if err := r.db.Where("user_id = ? AND event_id = ?", "alice", "game_save_deleted").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Details != "game/1" {
+		t.Errorf("deletion events = %+v, want one for game/1", events)
+	}
+
+	// The deleted save is kept as a revision and can be restored.
+	revisions, err := r.ListRevisions("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Fatalf("kept %d revisions, want 1", len(revisions))
+	}
+	if _, err := r.RestoreRevision("alice", revisions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if save, err := r.GetSave("alice", "game", 1); err != nil || save.SaveData != "data" {
+		t.Errorf("GetSave after restoring = %v, %v", save, err)
+	}
+}
+
+func TestPutSaveConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    []uint64 // expected revisions of the writes before the one tested
+		expected uint64
+		want     error
+		revision uint64
+	}{
+		{"empty slot", nil, 0, nil, 1},
+		{"empty slot, stale revision", nil, 1, ErrConflict, 0},
+		{"current revision", []uint64{0, 1}, 2, nil, 3},
+		{"stale revision", []uint64{0, 1}, 1, ErrConflict, 0},
+		{"expecting an empty slot", []uint64{0}, 0, ErrConflict, 0},
+		{"newer than current", []uint64{0}, 5, ErrConflict, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			for _, expected := range test.setup {
+				if _, err := r.PutSave("alice", "game", 1, "data", expected); err != nil {
+					t.Fatal(err)
+				}
+			}
+			revision, err := r.PutSave("alice", "game", 1, "new data", test.expected)
+			if !errors.Is(err, test.want) || revision != test.revision {
+				t.Errorf("PutSave = %d, %v, want %d, %v", revision, err, test.revision, test.want)
+			}
+		})
+	}
+}
+
+func TestRevisionAfterDelete(t *testing.T) {
+	r := newTestRepository(t)
+	if _, err := r.PutSave("alice", "game", 1, "one", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.PutSave("alice", "game", 1, "two", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteSave("alice", "game", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that read revision 2 before the delete mustn't be able to overwrite the new save.
+	revision, err := r.PutSave("alice", "game", 1, "three", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 3 {
+		t.Errorf("revision after deleting = %d, want 3", revision)
+	}
+	if _, err := r.PutSave("alice", "game", 1, "stale", 2); !errors.Is(err, ErrConflict) {
+		t.Errorf("PutSave with the revision from before the delete = %v, want ErrConflict", err)
+	}
+
+	// Restoring into an empty slot doesn't go back either.
+	if err := r.DeleteSave("alice", "game", 1); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := r.ListRevisions("alice", "game", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision, err = r.RestoreRevision("alice", revisions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if revision != 4 {
+		t.Errorf("revision after restoring = %d, want 4", revision)
+	}
+}
+
+func TestForcePut(t *testing.T) {
+	r := newTestRepository(t)
+	if _, err := r.PutSave("alice", "game", 1, "one", 0); err != nil {
+		t.Fatal(err)
+	}
+	revision, err := r.ForcePut("alice", "game", 1, "two")
+	if err != nil || revision != 2 {
+		t.Errorf("ForcePut = %d, %v, want 2", revision, err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotas Quotas
+		game   int64          // DeveloperGame.SaveQuota
+		setup  map[string]int // sizes of existing saves, by "game/slot"
+		gameID string
+		slot   uint8
+		size   int
+		scope  string // of the expected QuotaError, or empty
+	}{
+		{"no limits", Quotas{}, 0, nil, "game", 1, 1000, ""},
+		{"save fits", Quotas{PerSave: 100}, 0, nil, "game", 1, 50, ""},
+		{"save too large", Quotas{PerSave: 100}, 0, nil, "game", 1, 200, "save"},
+		{"game full", Quotas{PerGame: 150}, 0, map[string]int{"game/2": 100}, "game", 1, 100, "game"},
+		{"other game", Quotas{PerGame: 150}, 0, map[string]int{"other/1": 100}, "game", 1, 100, ""},
+		{"replaced save isn't counted", Quotas{PerGame: 150}, 0, map[string]int{"game/1": 100}, "game", 1, 100, ""},
+		{"game override", Quotas{PerGame: 150}, 300, map[string]int{"game/2": 100}, "game", 1, 100, ""},
+		{"user full", Quotas{PerUser: 250}, 0, map[string]int{"game/2": 100, "other/1": 100}, "game", 1, 100, "user"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			if err := r.db.Model(&types.DeveloperGame{}).Where("id = ?", "game").Update("save_quota", test.game).Error; err != nil {
+				t.Fatal(err)
+			}
+			for key, size := range test.setup {
+				gameID, slot, _ := strings.Cut(key, "/")
+				if _, err := r.ForcePut("alice", gameID, slot[0]-'0', randomData(size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r.SetQuotas(test.quotas)
+
+			_, err := r.ForcePut("alice", test.gameID, test.slot, randomData(test.size))
+			var quotaErr *QuotaError
+			switch {
+			case test.scope == "" && err != nil:
+				t.Errorf("ForcePut = %v, want no error", err)
+			case test.scope != "" && !errors.As(err, &quotaErr):
+				t.Errorf("ForcePut = %v, want a %s QuotaError", err, test.scope)
+			case test.scope != "" && quotaErr.Scope != test.scope:
+				t.Errorf("ForcePut = %v, want a %s QuotaError", err, test.scope)
+			}
+		})
+	}
+}
+
+// randomData returns n incompressible bytes, so that the stored size is close to n.
+func randomData(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return string(buf)
+}
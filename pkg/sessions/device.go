@@ -0,0 +1,90 @@
+package sessions
+
+import (
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceUnknown = "unknown"
+)
+
+// GeoLocator resolves an IP address to a coarse region, such as "US-CA" or "DE".
+// Implementations are expected to work offline, e.g. from a bundled GeoIP database.
+type GeoLocator interface {
+	Region(ip string) (string, bool)
+}
+
+// Device is the metadata parsed from a user agent string.
+type Device struct {
+	Browser string
+	OS      string
+	Class   string
+}
+
+// Matches reports whether two devices look like the same browser on the same platform.
+func (d Device) Matches(other Device) bool {
+	return d.Browser == other.Browser && d.OS == other.OS && d.Class == other.Class
+}
+
+// The order of these matters: many user agents mention several browsers, e.g. Edge
+// includes "Chrome" and "Safari", so the more specific names come first.
+var browsers = []struct{ token, name string }{
+	{"edg/", "Edge"},
+	{"opr/", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"crios/", "Chrome"},
+	{"chrome/", "Chrome"},
+	{"safari/", "Safari"},
+}
+
+var systems = []struct{ token, name string }{
+	{"windows", "Windows"},
+	{"iphone", "iOS"},
+	{"ipad", "iPadOS"},
+	{"android", "Android"},
+	{"cros", "ChromeOS"},
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	{"linux", "Linux"},
+}
+
+// ParseUserAgent extracts the browser, operating system and device class from a user agent.
+// It only recognises the common cases; anything else is reported as "Other" or DeviceUnknown.
+func ParseUserAgent(userAgent string) Device {
+	ua := strings.ToLower(userAgent)
+	device := Device{Browser: "Other", OS: "Other", Class: DeviceUnknown}
+	if ua == "" {
+		return device
+	}
+
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			device.Browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			device.OS = s.name
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "spider") || strings.Contains(ua, "crawl"):
+		device.Class = DeviceBot
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") || (device.OS == "Android" && !strings.Contains(ua, "mobile")):
+		device.Class = DeviceTablet
+	case strings.Contains(ua, "mobi") || device.OS == "iOS":
+		device.Class = DeviceMobile
+	case device.OS != "Other":
+		device.Class = DeviceDesktop
+	}
+	return device
+}
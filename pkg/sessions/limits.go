@@ -0,0 +1,72 @@
+package sessions
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LimitPolicy decides what happens when a user at their session limit logs in again.
+type LimitPolicy uint8
+
+const (
+	// RejectNew refuses to create the session.
+	RejectNew LimitPolicy = iota
+
+	// EvictOldest deletes the user's oldest sessions to make room.
+	EvictOldest
+)
+
+var ErrSessionLimit = errors.New("too many active sessions")
+
+// SetLimit caps the number of unexpired sessions a single user can hold. A limit of zero
+// or less removes the cap.
+func (s *SessionStore) SetLimit(limit int, policy LimitPolicy) {
+	s.limit = limit
+	s.policy = policy
+}
+
+// enforceLimit makes room for one more session for the user, according to the store's
+// policy. It locks the user's row first, so that parallel logins are serialised and can't
+// exceed the limit together. The IDs of evicted sessions are returned so that the caller can
+// drop them from the cache once the transaction commits.
+func (s *SessionStore) enforceLimit(tx *gorm.DB, userID string) ([]string, error) {
+	if s.limit <= 0 {
+		return nil, nil
+	}
+
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userID).First(&types.User{}).Error; err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if err := tx.Model(&types.UserSession{}).
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("created_at").
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	excess := len(ids) - s.limit + 1
+	if excess <= 0 {
+		return nil, nil
+	}
+	if s.policy == RejectNew {
+		return nil, ErrSessionLimit
+	}
+
+	evicted := ids[:excess]
+	if err := tx.Where("id IN ?", evicted).Delete(&types.UserSession{}).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range evicted {
+		if err := dbutil.LogUserEvent(tx, userID, "user_session_deleted", id, true); err != nil {
+			return nil, err
+		}
+	}
+	return evicted, nil
+}
@@ -0,0 +1,353 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultTTL is how long a session stays valid without being touched.
+const DefaultTTL = 7 * 24 * time.Hour
+
+// cacheKey is the DBCache key type used for validated sessions.
+const cacheKey = "session"
+
+// SecretSize is the number of random bytes in a session token's secret.
+const SecretSize = 32
+
+var (
+	ErrNotFound     = errors.New("session not found")
+	ErrExpired      = errors.New("session expired")
+	ErrInvalidToken = errors.New("invalid session token")
+)
+
+// SessionStore creates, validates and revokes user sessions.
+// Sessions created before token hashing have no TokenHash and never validate.
+// Validated sessions are kept in a DBCache, and revocations evict them immediately.
+type SessionStore struct {
+	db    *gorm.DB
+	cache *types.DBCache
+	ttl   time.Duration
+	geo   GeoLocator
+
+	limit  int
+	policy LimitPolicy
+}
+
+// NewSessionStore creates a SessionStore. If cache is nil, a new one is created.
+// A non-positive ttl falls back to DefaultTTL.
+func NewSessionStore(db *gorm.DB, cache *types.DBCache, ttl time.Duration) *SessionStore {
+	if db == nil {
+		panic("Got nil database")
+	}
+	if cache == nil {
+		cache = types.NewDBCache()
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &SessionStore{db: db, cache: cache, ttl: ttl}
+}
+
+// SetGeoLocator enables coarse region lookups for new sessions. Passing nil disables them.
+func (s *SessionStore) SetGeoLocator(geo GeoLocator) {
+	s.geo = geo
+}
+
+// Create starts a new session for the user and returns it along with the token to hand to
+// the client. The token is not stored and can't be recovered later.
+// If the user is at the session limit, ErrSessionLimit is returned or older sessions are
+// evicted, depending on the policy given to SetLimit.
+func (s *SessionStore) Create(userID string, userAgent string, origin string, ip string) (*types.UserSession, *types.TokenBody, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	device := ParseUserAgent(userAgent)
+	session := &types.UserSession{
+		ID:          ulid.Make().String(),
+		UserID:      userID,
+		TokenHash:   hashSecret(secret),
+		UserAgent:   userAgent,
+		Origin:      origin,
+		IP:          ip,
+		ExpiresAt:   now.Add(s.ttl),
+		Browser:     device.Browser,
+		OS:          device.OS,
+		DeviceClass: device.Class,
+		LastSeenAt:  now,
+		LastIP:      ip,
+	}
+	if s.geo != nil {
+		if region, ok := s.geo.Region(ip); ok {
+			session.Region = &region
+		}
+	}
+
+	var evicted []string
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if evicted, err = s.enforceLimit(tx, userID); err != nil {
+			return err
+		}
+		known, err := knownDevice(tx, userID, device, now)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		if err := dbutil.LogUserEvent(tx, userID, "user_session_created", session.ID, true); err != nil {
+			return err
+		}
+		if !known {
+			return dbutil.LogUserEvent(tx, userID, "user_session_new_device", describeDevice(session), true)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	s.Evict(evicted...)
+	s.cache.Set(cacheKey, session, session.ID)
+	return session, types.NewTokenBody(session.ID, secret), nil
+}
+
+// Validate returns the session the token belongs to if the secret matches and the session
+// hasn't expired.
+func (s *SessionStore) Validate(token *types.TokenBody) (*types.UserSession, error) {
+	id, secret, err := token.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare the hashes in constant time, so that the stored hash can't be probed byte by byte.
+	if subtle.ConstantTimeCompare([]byte(session.TokenHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		s.cache.Delete(cacheKey, id)
+		return nil, ErrExpired
+	}
+	return session, nil
+}
+
+// get loads a session by ID, going through the cache first.
+func (s *SessionStore) get(id string) (*types.UserSession, error) {
+	if cached, hit := s.cache.Get(cacheKey, id); hit {
+		return cached.(*types.UserSession), nil
+	}
+
+	session := &types.UserSession{}
+	if err := s.db.Where("id = ?", id).First(session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	s.cache.Set(cacheKey, session, session.ID)
+	return session, nil
+}
+
+// Touch validates the token, pushes the session's expiry back by the store's TTL and records
+// the time and IP it was last seen from.
+func (s *SessionStore) Touch(token *types.TokenBody, ip string) (*types.UserSession, error) {
+	session, err := s.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	if err := s.db.Model(&types.UserSession{}).Where("id = ?", session.ID).Updates(map[string]any{
+		"expires_at":   expires,
+		"last_seen_at": now,
+		"last_ip":      ip,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	// Copy before updating, since the cached pointer may be in use elsewhere.
+	touched := *session
+	touched.ExpiresAt = expires
+	touched.LastSeenAt = now
+	touched.LastIP = ip
+	s.cache.Set(cacheKey, &touched, session.ID)
+	return &touched, nil
+}
+
+// ActiveDevices returns the user's unexpired sessions, most recently seen first.
+func (s *SessionStore) ActiveDevices(userID string) ([]*types.UserSession, error) {
+	var sessions []*types.UserSession
+	if err := s.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Revoke deletes a single session.
+func (s *SessionStore) Revoke(id string) error {
+	session := &types.UserSession{}
+	if err := s.db.Where("id = ?", id).First(session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return s.revoke(session.UserID, s.db.Where("id = ?", id))
+}
+
+// RevokeAll deletes every session belonging to the user.
+func (s *SessionStore) RevokeAll(userID string) error {
+	return s.revoke(userID, s.db.Where("user_id = ?", userID))
+}
+
+// RevokeAllExcept deletes every session belonging to the user other than the current one.
+func (s *SessionStore) RevokeAllExcept(userID string, currentID string) error {
+	return s.revoke(userID, s.db.Where("user_id = ? AND id <> ?", userID, currentID))
+}
+
+// revoke deletes the sessions matched by query, evicting them from the cache and logging
+// a user_session_deleted event for each. They are evicted only once the deletion has
+// committed, since a concurrent Validate could otherwise cache them again.
+func (s *SessionStore) revoke(userID string, query *gorm.DB) error {
+	var ids []string
+	if err := query.Model(&types.UserSession{}).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id IN ?", ids).Delete(&types.UserSession{}).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := dbutil.LogUserEvent(tx, userID, "user_session_deleted", id, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	s.Evict(ids...)
+	return nil
+}
+
+// Evict drops sessions from the cache. Code that deletes or expires sessions without going
+// through the store must call it once its transaction has committed, or the sessions stay
+// valid until their cache entries expire.
+func (s *SessionStore) Evict(ids ...string) {
+	for _, id := range ids {
+		s.cache.Delete(cacheKey, id)
+	}
+}
+
+// Reap deletes every expired session and returns how many were removed.
+func (s *SessionStore) Reap() (int64, error) {
+	var ids []string
+	if err := s.db.Model(&types.UserSession{}).Where("expires_at <= ?", time.Now()).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	result := s.db.Where("id IN ?", ids).Delete(&types.UserSession{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	s.Evict(ids...)
+	return result.RowsAffected, nil
+}
+
+// StartReaper runs Reap every interval in the background until the returned function is called.
+func (s *SessionStore) StartReaper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count, err := s.Reap()
+				if err != nil {
+					log.Error("Failed to reap expired sessions: ", err)
+					continue
+				}
+				if count > 0 {
+					log.Debug("Reaped ", count, " expired sessions.")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// knownDevice reports whether the user has logged in from a matching device before, and adds
+// the device to their history. The history is kept after sessions end, so that reaped or
+// revoked sessions don't make their devices look new. A user's first device isn't treated as
+// new, since there is nothing to compare it with.
+func knownDevice(tx *gorm.DB, userID string, device Device, now time.Time) (bool, error) {
+	var devices []*types.UserDevice
+	if err := tx.Where("user_id = ?", userID).Find(&devices).Error; err != nil {
+		return false, err
+	}
+	known := len(devices) == 0
+	for _, seen := range devices {
+		if device.Matches(Device{seen.Browser, seen.OS, seen.DeviceClass}) {
+			known = true
+			break
+		}
+	}
+
+	if err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "browser"}, {Name: "os"}, {Name: "device_class"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_seen_at"}),
+	}).Create(&types.UserDevice{
+		UserID:      userID,
+		Browser:     device.Browser,
+		OS:          device.OS,
+		DeviceClass: device.Class,
+		FirstSeenAt: now,
+		LastSeenAt:  now,
+	}).Error; err != nil {
+		return false, err
+	}
+	return known, nil
+}
+
+func describeDevice(session *types.UserSession) string {
+	description := session.Browser + " on " + session.OS + " (" + session.DeviceClass + ")"
+	if session.Region != nil {
+		description += " from " + *session.Region
+	}
+	return description
+}
+
+// hashSecret returns the hex-encoded SHA-256 hash of a token secret, as stored in UserSession.TokenHash.
+func hashSecret(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,89 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func newTestStore(t *testing.T) *SessionStore {
+	db := dbtest.Open(t, &types.User{}, &types.UserSession{}, &types.UserDevice{}, &types.UserEvent{})
+	return NewSessionStore(db, nil, 0)
+}
+
+func TestRevokeEvictsCachedSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(s *SessionStore, session *types.UserSession) error
+	}{
+		{"Revoke", func(s *SessionStore, session *types.UserSession) error { return s.Revoke(session.ID) }},
+		{"RevokeAll", func(s *SessionStore, session *types.UserSession) error { return s.RevokeAll(session.UserID) }},
+		{"RevokeAllExcept", func(s *SessionStore, session *types.UserSession) error {
+			return s.RevokeAllExcept(session.UserID, "other")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t)
+			session, token, err := s.Create("user", "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0", "https://example.com", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Validate(token); err != nil {
+				t.Fatalf("Validate before revoking: %v", err)
+			}
+
+			if err := test.revoke(s, session); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Validate(token); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Validate after revoking = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestNewDeviceAlerts(t *testing.T) {
+	const (
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+		chrome  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"
+	)
+	s := newTestStore(t)
+
+	// Every login is followed by revoking all sessions, so that only the device history
+	// remembers earlier devices.
+	logins := []struct {
+		userAgent string
+		alert     bool
+	}{
+		{firefox, false}, // first device
+		{firefox, false},
+		{chrome, true},
+		{chrome, false},
+		{firefox, false},
+	}
+	for i, login := range logins {
+		if _, _, err := s.Create("user", login.userAgent, "https://example.com", "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RevokeAll("user"); err != nil {
+			t.Fatal(err)
+		}
+
+		var alerts int64
+		if err := s.db.Model(&types.UserEvent{}).Where("event_id = ?", "user_session_new_device").Count(&alerts).Error; err != nil {
+			t.Fatal(err)
+		}
+		want := int64(0)
+		for _, previous := range logins[:i+1] {
+			if previous.alert {
+				want++
+			}
+		}
+		if alerts != want {
+			t.Fatalf("after login %d: %d new device alerts, want %d", i, alerts, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package softdelete
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+)
+
+// DefaultRestoreWindow is how long a soft-deleted row can be restored before it becomes eligible for purging.
+const DefaultRestoreWindow = 30 * 24 * time.Hour
+
+var (
+	ErrNotDeleted    = errors.New("record is not deleted")
+	ErrWindowExpired = errors.New("restore window has expired")
+	ErrNotFound      = errors.New("record not found")
+)
+
+// Models lists the soft-deletable models, ordered so that children are purged before their parents.
+var Models = []any{
+	&types.DeveloperGame{},
+	&types.Developer{},
+	&types.User{},
+}
+
+// Restore clears the deletion mark on the row of model with the given ID, as long as it was
+// deleted less than window ago.
+func Restore(db *gorm.DB, model any, id string, window time.Duration) error {
+	var row struct{ DeletedAt gorm.DeletedAt }
+	result := db.Unscoped().Model(model).Select("deleted_at").Where("id = ?", id).Limit(1).Find(&row)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	if !row.DeletedAt.Valid {
+		return ErrNotDeleted
+	}
+
+	if time.Since(row.DeletedAt.Time) > window {
+		return ErrWindowExpired
+	}
+
+	return db.Unscoped().Model(model).Where("id = ?", id).Update("deleted_at", nil).Error
+}
+
+// Purge hard-deletes every row of model that was soft-deleted more than window ago.
+// Foreign key constraints take care of the dependent rows.
+func Purge(db *gorm.DB, model any, window time.Duration) (int64, error) {
+	result := db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-window)).Delete(model)
+	return result.RowsAffected, result.Error
+}
+
+// PurgeAll runs Purge over every model in Models.
+func PurgeAll(db *gorm.DB, window time.Duration) (int64, error) {
+	var total int64
+	for _, model := range Models {
+		count, err := Purge(db, model, window)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// StartPurger runs PurgeAll every interval in the background until the returned function is called.
+func StartPurger(db *gorm.DB, interval time.Duration, window time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count, err := PurgeAll(db, window)
+				if err != nil {
+					log.Error("Failed to purge soft-deleted records: ", err)
+					continue
+				}
+				if count > 0 {
+					log.Info("Purged ", count, " soft-deleted records.")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,252 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// cacheKey is the DBCache key type used for failure counters.
+const cacheKey = "login_failures"
+
+// Config controls how many failures are tolerated and how long lockouts last.
+type Config struct {
+	// Window is the sliding window in which failures are counted.
+	Window time.Duration
+
+	// UserThreshold and IPThreshold are the number of failures within Window that trigger a
+	// lockout for a user or an IP address respectively.
+	UserThreshold int
+	IPThreshold   int
+
+	// BaseLockout is the duration of the first lockout. Each consecutive lockout doubles it,
+	// up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+
+	// ResetAfter is how long a subject has to stay out of trouble before its lockout count
+	// starts over.
+	ResetAfter time.Duration
+}
+
+// DefaultConfig is used for any zero fields in the config given to NewThrottle.
+var DefaultConfig = Config{
+	Window:        15 * time.Minute,
+	UserThreshold: 5,
+	IPThreshold:   20,
+	BaseLockout:   time.Minute,
+	MaxLockout:    24 * time.Hour,
+	ResetAfter:    24 * time.Hour,
+}
+
+// LockedError is returned while a user or IP address is locked out.
+type LockedError struct {
+	Subject string
+	Until   time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked out until %s", e.Subject, e.Until.Format(time.RFC3339))
+}
+
+// ErrLocked can be used with errors.Is to check for a LockedError.
+var ErrLocked = errors.New("locked out")
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Throttle counts failed logins per user and per IP address, and locks them out with
+// exponentially growing durations. Counters live in a DBCache, while lockouts are persisted so
+// that every backend instance enforces them.
+type Throttle struct {
+	db     *gorm.DB
+	cache  *types.DBCache
+	config Config
+	lock   sync.Mutex
+}
+
+// NewThrottle creates a Throttle. If cache is nil, a new one is created.
+func NewThrottle(db *gorm.DB, cache *types.DBCache, config Config) *Throttle {
+	if db == nil {
+		panic("Got nil database")
+	}
+	if cache == nil {
+		cache = types.NewDBCache()
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultConfig.Window
+	}
+	if config.UserThreshold <= 0 {
+		config.UserThreshold = DefaultConfig.UserThreshold
+	}
+	if config.IPThreshold <= 0 {
+		config.IPThreshold = DefaultConfig.IPThreshold
+	}
+	if config.BaseLockout <= 0 {
+		config.BaseLockout = DefaultConfig.BaseLockout
+	}
+	if config.MaxLockout <= 0 {
+		config.MaxLockout = DefaultConfig.MaxLockout
+	}
+	if config.ResetAfter <= 0 {
+		config.ResetAfter = DefaultConfig.ResetAfter
+	}
+	return &Throttle{db: db, cache: cache, config: config}
+}
+
+func userSubject(userID string) string {
+	return "user:" + userID
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns a LockedError if the user or the IP address is currently locked out.
+// Either argument may be empty, e.g. when the username didn't match any user.
+func (t *Throttle) Check(userID string, ip string) error {
+	subjects := t.subjects(userID, ip)
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	var lockouts []*types.LoginLockout
+	if err := t.db.Where("subject IN ? AND expires_at > ?", subjects, time.Now()).Order("expires_at DESC").Find(&lockouts).Error; err != nil {
+		return err
+	}
+	if len(lockouts) > 0 {
+		return &LockedError{Subject: lockouts[0].Subject, Until: lockouts[0].ExpiresAt}
+	}
+	return nil
+}
+
+// Failure records a failed login and locks out the user or IP address if it crossed its
+// threshold. The resulting LockedError is returned in that case.
+func (t *Throttle) Failure(userID string, ip string) error {
+	var locked error
+	if userID != "" && t.record(userSubject(userID)) >= t.config.UserThreshold {
+		until, err := t.lockout(userSubject(userID))
+		if err != nil {
+			return err
+		}
+		// The IP address is left out, since the event log outlives anonymization.
+		if err := dbutil.LogUserEvent(t.db, userID, "user_locked_out", "until "+until.UTC().Format(time.RFC3339), false); err != nil {
+			return err
+		}
+		locked = &LockedError{Subject: userSubject(userID), Until: until}
+	}
+	if ip != "" && t.record(ipSubject(ip)) >= t.config.IPThreshold {
+		until, err := t.lockout(ipSubject(ip))
+		if err != nil {
+			return err
+		}
+		if locked == nil {
+			locked = &LockedError{Subject: ipSubject(ip), Until: until}
+		}
+	}
+	return locked
+}
+
+// Success clears the user's failure counter after a successful login. The IP address counter
+// is left alone, since one good login says little about the rest of the traffic from it.
+func (t *Throttle) Success(userID string) {
+	if userID != "" {
+		t.cache.Delete(cacheKey, userSubject(userID))
+	}
+}
+
+// UnlockUser lifts a user's lockout and resets their counters. It is meant for administrators.
+func (t *Throttle) UnlockUser(userID string) error {
+	if err := t.unlock(userSubject(userID)); err != nil {
+		return err
+	}
+	return dbutil.LogUserEvent(t.db, userID, "user_unlocked", "", true)
+}
+
+// UnlockIP lifts an IP address lockout and resets its counters. It is meant for administrators.
+func (t *Throttle) UnlockIP(ip string) error {
+	return t.unlock(ipSubject(ip))
+}
+
+// Cleanup deletes lockouts that expired longer than ResetAfter ago, since their count would
+// start over anyway.
+func (t *Throttle) Cleanup() (int64, error) {
+	result := t.db.Where("expires_at < ?", time.Now().Add(-t.config.ResetAfter)).Delete(&types.LoginLockout{})
+	return result.RowsAffected, result.Error
+}
+
+func (t *Throttle) subjects(userID string, ip string) []string {
+	var subjects []string
+	if userID != "" {
+		subjects = append(subjects, userSubject(userID))
+	}
+	if ip != "" {
+		subjects = append(subjects, ipSubject(ip))
+	}
+	return subjects
+}
+
+// record adds a failure for the subject and returns the number of failures within the window.
+func (t *Throttle) record(subject string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-t.config.Window)
+
+	var failures []time.Time
+	if cached, hit := t.cache.Get(cacheKey, subject); hit {
+		for _, failure := range cached.([]time.Time) {
+			if failure.After(cutoff) {
+				failures = append(failures, failure)
+			}
+		}
+	}
+	failures = append(failures, now)
+	t.cache.SetFor(cacheKey, failures, t.config.Window, subject)
+	return len(failures)
+}
+
+// lockout persists a lockout for the subject, doubling its duration for every consecutive
+// lockout, and clears the subject's counter so that it starts fresh once the lockout ends.
+func (t *Throttle) lockout(subject string) (time.Time, error) {
+	t.cache.Delete(cacheKey, subject)
+
+	var until time.Time
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		lockout := &types.LoginLockout{Subject: subject}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("subject = ?", subject).Limit(1).Find(lockout).Error; err != nil {
+			return err
+		}
+		if lockout.ExpiresAt.Before(now.Add(-t.config.ResetAfter)) {
+			lockout.Count = 0
+		}
+		lockout.Count++
+
+		duration := t.config.BaseLockout
+		for i := uint16(1); i < lockout.Count && duration < t.config.MaxLockout; i++ {
+			duration *= 2
+		}
+		if duration > t.config.MaxLockout {
+			duration = t.config.MaxLockout
+		}
+		until = now.Add(duration)
+		lockout.ExpiresAt = until
+
+		return tx.Save(lockout).Error
+	})
+	return until, err
+}
+
+func (t *Throttle) unlock(subject string) error {
+	t.cache.Delete(cacheKey, subject)
+	return t.db.Where("subject = ?", subject).Delete(&types.LoginLockout{}).Error
+}
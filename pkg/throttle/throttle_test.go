@@ -0,0 +1,108 @@
+package throttle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func newTestThrottle(t *testing.T, config Config) *Throttle {
+	db := dbtest.Open(t, &types.User{}, &types.UserEvent{}, &types.LoginLockout{})
+	if err := db.Create(&types.User{ID: "user", Username: "user", Email: "user@example.com"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewThrottle(db, nil, config)
+}
+
+// lockoutDuration records a failure that must cause a lockout and returns its duration.
+func lockoutDuration(t *testing.T, th *Throttle) time.Duration {
+	t.Helper()
+	now := time.Now()
+	var locked *LockedError
+	if err := th.Failure("user", "192.0.2.1"); !errors.As(err, &locked) {
+		t.Fatalf("Failure = %v, want a LockedError", err)
+	}
+	return locked.Until.Sub(now).Round(time.Minute)
+}
+
+func TestWindow(t *testing.T) {
+	th := newTestThrottle(t, Config{Window: 100 * time.Millisecond, UserThreshold: 3})
+	for i := 0; i < 2; i++ {
+		if err := th.Failure("user", "192.0.2.1"); err != nil {
+			t.Fatalf("failure %d: %v", i+1, err)
+		}
+	}
+
+	// The first failures fall out of the window.
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := th.Failure("user", "192.0.2.1"); err != nil {
+			t.Fatalf("failure %d after the window: %v", i+1, err)
+		}
+	}
+	if err := th.Failure("user", "192.0.2.1"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("third failure within the window = %v, want ErrLocked", err)
+	}
+	if err := th.Check("user", ""); !errors.Is(err, ErrLocked) {
+		t.Errorf("Check while locked out = %v, want ErrLocked", err)
+	}
+	if err := th.Check("", "192.0.2.2"); err != nil {
+		t.Errorf("Check for another IP = %v, want nil", err)
+	}
+
+	var events []*types.UserEvent
+	if err := th.db.Where("user_id = ? AND event_id = ?", "user", "user_locked_out").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || strings.Contains(events[0].Details, "192.0.2.1") {
+		t.Errorf("lockout events = %+v, want one without the IP address", events)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	th := newTestThrottle(t, Config{UserThreshold: 1, BaseLockout: time.Minute, MaxLockout: 5 * time.Minute})
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if got := lockoutDuration(t, th); got != want {
+			t.Errorf("lockout %d lasts %s, want %s", i+1, got, want)
+		}
+	}
+
+	if err := th.UnlockUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Check("user", ""); err != nil {
+		t.Errorf("Check after UnlockUser = %v, want nil", err)
+	}
+	if got := lockoutDuration(t, th); got != time.Minute {
+		t.Errorf("lockout after UnlockUser lasts %s, want %s", got, time.Minute)
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	th := newTestThrottle(t, Config{UserThreshold: 1, BaseLockout: time.Minute, ResetAfter: time.Hour})
+	lockoutDuration(t, th)
+	if got := lockoutDuration(t, th); got != 2*time.Minute {
+		t.Fatalf("second lockout lasts %s, want %s", got, 2*time.Minute)
+	}
+
+	// Pretend the last lockout ended longer than ResetAfter ago.
+	expire := func() {
+		t.Helper()
+		if err := th.db.Model(&types.LoginLockout{}).Where("subject = ?", userSubject("user")).Update("expires_at", time.Now().Add(-2*time.Hour)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire()
+	if got := lockoutDuration(t, th); got != time.Minute {
+		t.Errorf("lockout after ResetAfter lasts %s, want %s", got, time.Minute)
+	}
+
+	expire()
+	if count, err := th.Cleanup(); count != 1 || err != nil {
+		t.Errorf("Cleanup = %d, %v, want 1", count, err)
+	}
+}
@@ -40,6 +40,15 @@ func (c *DBCache) Set(keytype string, value any, keys ...string) {
 	c.cache.SetDefault(key, value)
 }
 
+// SetFor stores a value that expires after ttl instead of the default expiration.
+func (c *DBCache) SetFor(keytype string, value any, ttl time.Duration, keys ...string) {
+	c.init()
+	key := c.make_key(keytype, keys...)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Set(key, value, ttl)
+}
+
 func (c *DBCache) Get(keytype string, keys ...string) (any, bool) {
 	c.init()
 	key := c.make_key(keytype, keys...)
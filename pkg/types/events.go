@@ -25,12 +25,24 @@ var UserEvents map[string][]any = map[string][]any{
 	"user_deleted": {"User was successfully deleted", LogInfo},
 	"user_error":   {"User error", LogError},
 
+	"user_anonymize_step": {"User anonymization step completed", LogInfo},
+	"user_anonymized":     {"User was successfully anonymized", LogInfo},
+
 	"user_login":  {"User was successfully logged in", LogInfo},
 	"user_logout": {"User was successfully logged out", LogInfo},
 
-	"user_session_created": {"User session was successfully created", LogInfo},
-	"user_session_deleted": {"User session was successfully deleted", LogInfo},
-	"user_session_error":   {"User session error", LogError},
+	"user_email_change_started":   {"User requested an email change", LogInfo},
+	"user_email_change_cancelled": {"User cancelled an email change", LogInfo},
+	"user_email_changed":          {"User email was successfully changed", LogInfo},
+	"user_email_change_reverted":  {"User email change was reverted", LogWarn},
+
+	"user_identity_linked":   {"External login provider was linked", LogInfo},
+	"user_identity_unlinked": {"External login provider was unlinked", LogInfo},
+
+	"user_session_created":    {"User session was successfully created", LogInfo},
+	"user_session_deleted":    {"User session was successfully deleted", LogInfo},
+	"user_session_error":      {"User session error", LogError},
+	"user_session_new_device": {"User logged in from a new device", LogWarn},
 
 	"developer_member_created": {"Developer member was successfully created", LogInfo},
 	"developer_member_deleted": {"Developer member was successfully deleted", LogInfo},
@@ -39,13 +51,29 @@ var UserEvents map[string][]any = map[string][]any{
 	"game_save_deleted": {"Game save was successfully deleted", LogInfo},
 	"game_save_error":   {"Game save error", LogError},
 
+	"game_save_restored": {"Game save was restored from a previous revision", LogInfo},
+
+	"user_secret_rotated":          {"User secret was rotated and saves were re-encrypted", LogInfo},
+	"user_secret_rotation_failure": {"Failed to rotate user secret", LogError},
+
 	"user_auth_password_error": {"Password authentication error", LogError},
+	"user_locked_out":          {"User was locked out after too many failed logins", LogWarn},
+	"user_unlocked":            {"User login lockout was lifted by an administrator", LogInfo},
+	"user_password_changed":    {"User password was changed", LogInfo},
+	"user_password_rehashed":   {"User password hash was upgraded", LogInfo},
+	"user_password_reused":     {"User tried to reuse a recent password", LogWarn},
 
 	"user_totp_enroll_started": {"User started TOTP enrollment", LogInfo},
 	"user_totp_enroll_success": {"User successfully enrolled TOTP", LogInfo},
 	"user_totp_enroll_failure": {"User failed to enroll TOTP", LogError},
+	"user_totp_removed":        {"User removed a TOTP authenticator", LogInfo},
 	"user_auth_totp_error":     {"TOTP authentication error", LogError},
 
+	"user_passkey_registered":    {"User registered a passkey", LogInfo},
+	"user_passkey_used":          {"User authenticated with a passkey", LogInfo},
+	"user_passkey_removed":       {"User removed a passkey", LogInfo},
+	"user_passkey_clone_warning": {"Passkey signature counter went backwards; possible cloned authenticator", LogWarn},
+
 	"user_verify_sent":              {"User verification code was sent", LogInfo},
 	"user_verify_set_failure":       {"Failed to set verification code", LogError},
 	"user_verify_bypassed_test":     {"User verification was bypassed; testing mode enabled", LogWarn},
@@ -1,5 +1,37 @@
 package types
 
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// TokenVersion is the current version prefix of session tokens.
+const TokenVersion = "v1"
+
+var ErrMalformedToken = errors.New("malformed token")
+
 type TokenBody struct {
 	Token string `json:"token"`
 }
+
+// NewTokenBody encodes a session ID and its secret into an opaque, versioned token.
+// The format is "v1.<session ID>.<base64url secret>".
+func NewTokenBody(sessionID string, secret []byte) *TokenBody {
+	return &TokenBody{
+		Token: strings.Join([]string{TokenVersion, sessionID, base64.RawURLEncoding.EncodeToString(secret)}, "."),
+	}
+}
+
+// Parse splits the token back into the session ID and secret.
+func (t *TokenBody) Parse() (sessionID string, secret []byte, err error) {
+	parts := strings.Split(t.Token, ".")
+	if len(parts) != 3 || parts[0] != TokenVersion || parts[1] == "" {
+		return "", nil, ErrMalformedToken
+	}
+	secret, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(secret) == 0 {
+		return "", nil, ErrMalformedToken
+	}
+	return parts[1], secret, nil
+}
@@ -4,19 +4,22 @@ import (
 	"time"
 
 	"github.com/cloudlink-omega/storage/pkg/bitfield"
+	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        string             `gorm:"primaryKey;type:char(26);unique;not null"`
-	Username  string             `gorm:"unique;not null;min:1;max:20"`
-	Email     string             `gorm:"unique;not null;min:1;max:255"`
-	Password  string             `gorm:"type:mediumtext"`
-	Secret    string             `gorm:"type:mediumtext"`
-	State     bitfield.Bitfield8 `gorm:"not null;default:0;"`
-	AvatarID  *string
-	BannerID  *string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID            string             `gorm:"primaryKey;type:char(26);unique;not null"`
+	Username      string             `gorm:"unique;not null;size:20"`
+	Email         string             `gorm:"unique;not null;size:255"`
+	Password      string             `gorm:"type:mediumtext"`
+	Secret        string             `gorm:"type:mediumtext"`
+	SecretVersion uint16             `gorm:"not null;default:0"`
+	State         bitfield.Bitfield8 `gorm:"not null;default:0;"`
+	AvatarID      *string
+	BannerID      *string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
 
 	Avatar          *Image             `gorm:"foreignKey:AvatarID;references:ID;constraint:OnDelete:SET NULL;"`
 	Banner          *Image             `gorm:"foreignKey:BannerID;references:ID;constraint:OnDelete:SET NULL;"`
@@ -25,9 +28,29 @@ type User struct {
 	GameComments    []*GameComment     `gorm:"foreignKey:UserID"`
 }
 
+// UserPassword is a password hash set by a user, along with the algorithm and parameters used
+// to produce it. Only one row per user IsCurrent; the others are kept as password history.
+// A user without a current row has never set a password, e.g. because they signed up via OAuth.
+// User.Password mirrors the current hash for existing callers.
+type UserPassword struct {
+	ID        string `gorm:"primaryKey;type:char(26);unique;not null"`
+	UserID    string `gorm:"type:char(26);not null;index"`
+	Algorithm string `gorm:"type:varchar(20);not null"`
+	Params    string `gorm:"type:tinytext"`
+	Hash      string `gorm:"type:mediumtext;not null"`
+	IsCurrent bool   `gorm:"not null;default:false"`
+	ChangedAt time.Time
+	CreatedAt time.Time
+
+	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
+// UserSession is a logged-in session. The client holds a token containing the session ID and
+// a random secret; only the SHA-256 hash of the secret is stored.
 type UserSession struct {
 	ID        string `gorm:"primaryKey;type:char(26);unique;not null"`
 	UserID    string `gorm:"not null"`
+	TokenHash string `gorm:"type:char(64)"`
 	UserAgent string `gorm:"mediumtext;not null"`
 	Origin    string `gorm:"mediumtext;not null"`
 	IP        string `gorm:"mediumtext;not null"`
@@ -35,9 +58,70 @@ type UserSession struct {
 	UpdatedAt time.Time
 	ExpiresAt time.Time
 
+	// Device metadata, parsed from the user agent and IP when the session is created.
+	Browser     string  `gorm:"type:tinytext"`
+	OS          string  `gorm:"type:tinytext"`
+	DeviceClass string  `gorm:"type:varchar(20)"`
+	Region      *string `gorm:"type:tinytext"`
+	LastSeenAt  time.Time
+	LastIP      string `gorm:"type:tinytext"`
+
+	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
+// UserDevice is a device a user has logged in from. It outlives the sessions it was seen in,
+// so that logging in from it again isn't reported as a new device.
+type UserDevice struct {
+	UserID      string `gorm:"primaryKey;type:char(26);not null"`
+	Browser     string `gorm:"primaryKey;type:varchar(50);not null"`
+	OS          string `gorm:"primaryKey;type:varchar(50);not null"`
+	DeviceClass string `gorm:"primaryKey;type:varchar(20);not null"`
+	FirstSeenAt time.Time
+	LastSeenAt  time.Time
+
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// UserIdentity links a user to an account on an external login provider.
+// Each account (Issuer, ProviderUserID) can only be linked to one user. For OIDC providers,
+// Issuer holds the issuer URL and ProviderUserID the subject claim; built-in providers use
+// their name as the issuer.
+// The provider's tokens are envelope-encrypted under the master key named by TokenKeyID.
+type UserIdentity struct {
+	ID              string `gorm:"primaryKey;type:char(26);unique;not null"`
+	Provider        string `gorm:"type:varchar(50);not null;index"`
+	Issuer          string `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identity_issuer_subject"`
+	ProviderUserID  string `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identity_issuer_subject"`
+	UserID          string `gorm:"type:char(26);not null;index"`
+	Email           string `gorm:"type:tinytext"`
+	DisplayName     string `gorm:"type:tinytext"`
+	AccessTokenEnc  string `gorm:"type:mediumtext"`
+	RefreshTokenEnc string `gorm:"type:mediumtext"`
+	TokenKeyID      string `gorm:"type:varchar(50);index"`
+	ExpiresAt       *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+
+	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
+// IdentityProvider configures an external login provider. Built-in providers use their
+// name as the ID and have no IssuerURL, while generic OIDC providers are keyed by their
+// issuer URL, which is unique.
+// ClientSecretEnc holds the client secret, encrypted by the caller.
+type IdentityProvider struct {
+	ID              string  `gorm:"primaryKey;type:varchar(50);unique;not null"`
+	DisplayName     string  `gorm:"type:tinytext;not null"`
+	IssuerURL       *string `gorm:"type:varchar(255);uniqueIndex:idx_identity_provider_issuer"`
+	ClientID        string  `gorm:"type:varchar(255);not null"`
+	ClientSecretEnc string  `gorm:"type:mediumtext"`
+	Scopes          string  `gorm:"type:tinytext"`
+	Enabled         bool    `gorm:"not null"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Deprecated: UserGoogle is only kept to migrate existing rows into UserIdentity.
 type UserGoogle struct {
 	ID        string `gorm:"primaryKey;type:varchar(255);not null;unique;"`
 	UserID    string `gorm:"not null"`
@@ -46,6 +130,7 @@ type UserGoogle struct {
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// Deprecated: UserDiscord is only kept to migrate existing rows into UserIdentity.
 type UserDiscord struct {
 	ID        string `gorm:"primaryKey;type:varchar(255);not null;unique;"`
 	UserID    string `gorm:"not null"`
@@ -54,6 +139,7 @@ type UserDiscord struct {
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// Deprecated: UserGitHub is only kept to migrate existing rows into UserIdentity.
 type UserGitHub struct {
 	ID        string `gorm:"primaryKey;type:varchar(255);not null;unique;"`
 	UserID    string `gorm:"not null"`
@@ -62,27 +148,87 @@ type UserGitHub struct {
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// UserTOTP is an authenticator app enrolled by a user. Enrollments start out pending and
+// only count as a second factor once confirmed. LastUsedStep is the last accepted time step,
+// so that the same code can't be used twice.
 type UserTOTP struct {
-	UserID    string `gorm:"not null"`
-	Secret    string `gorm:"type:mediumtext;not null"`
-	CreatedAt time.Time
+	ID           string `gorm:"primaryKey;type:char(26);unique;not null"`
+	UserID       string `gorm:"type:char(26);not null;index"`
+	Label        string `gorm:"type:tinytext;not null"`
+	Secret       string `gorm:"type:mediumtext;not null"`
+	Confirmed    bool   `gorm:"not null;default:false"`
+	ConfirmedAt  *time.Time
+	LastUsedStep uint64 `gorm:"not null;default:0"`
+	LastUsedAt   *time.Time
+	CreatedAt    time.Time
+
+	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
+// UserWebAuthnCredential is a passkey or security key registered by a user.
+// SignCount is the last signature counter reported by the authenticator; a counter that goes
+// backwards suggests a cloned authenticator and sets CloneWarning.
+type UserWebAuthnCredential struct {
+	ID             string `gorm:"primaryKey;type:char(26);unique;not null"`
+	UserID         string `gorm:"type:char(26);not null;index"`
+	CredentialID   []byte `gorm:"type:varbinary(1023);not null;uniqueIndex"`
+	PublicKey      []byte `gorm:"type:blob;not null"`
+	SignCount      uint32 `gorm:"not null;default:0"`
+	AAGUID         []byte `gorm:"type:binary(16)"`
+	Transports     string `gorm:"type:tinytext"`
+	BackupEligible bool   `gorm:"not null;default:false"`
+	BackupState    bool   `gorm:"not null;default:false"`
+	CloneWarning   bool   `gorm:"not null;default:false"`
+	Nickname       string `gorm:"type:tinytext"`
+	LastUsedAt     *time.Time
+	CreatedAt      time.Time
 
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// Verification is a one-time code sent to a user to confirm an action. Each user can only
+// have one active code per Purpose; issuing a new one replaces the old. Only an HMAC of
+// the code is stored, and the code is locked after too many failed Attempts.
 type Verification struct {
-	UserID    string `gorm:"type:char(26);not null"`
-	Code      string `gorm:"type:mediumtext;not null"`
+	UserID    string `gorm:"primaryKey;type:char(26);not null"`
+	Purpose   string `gorm:"primaryKey;type:varchar(30);not null"`
+	CodeHash  string `gorm:"type:char(64);not null"`
+	Attempts  uint8  `gorm:"not null;default:0"`
 	CreatedAt time.Time
 	ExpiresAt time.Time
 
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// RecoveryCode is a single-use code for getting into an account without the second factor.
+// Only a salted SHA-256 hash of the code is stored. Codes generated together share a BatchID,
+// and regenerating them replaces the whole batch.
 type RecoveryCode struct {
-	UserID    string `gorm:"type:char(26);not null"`
-	Code      string `gorm:"type:mediumtext;not null"`
-	CreatedAt time.Time
+	ID         string `gorm:"primaryKey;type:char(26);unique;not null"`
+	UserID     string `gorm:"type:char(26);not null;index"`
+	BatchID    string `gorm:"type:char(26);not null;index"`
+	Salt       string `gorm:"type:char(32);not null"`
+	CodeHash   string `gorm:"type:char(64);not null"`
+	UsedAt     *time.Time
+	UsedFromIP *string `gorm:"type:tinytext"`
+	CreatedAt  time.Time
+
+	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
+// PendingEmailChange tracks a requested change of a user's email address. A token is mailed
+// to the new address to confirm the change, and another to the old address so that the owner
+// can cancel it, or revert it until RevertUntil once it has gone through.
+type PendingEmailChange struct {
+	UserID       string `gorm:"primaryKey;type:char(26);not null"`
+	OldEmail     string `gorm:"size:255;not null"`
+	NewEmail     string `gorm:"size:255;not null"`
+	OldTokenHash string `gorm:"type:char(64);not null"`
+	NewTokenHash string `gorm:"type:char(64);not null"`
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	CompletedAt  *time.Time
+	RevertUntil  *time.Time
 
 	User *User `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
 }
@@ -187,10 +333,16 @@ type DeveloperEvent struct {
 
 // UserGameSave is used to store a user's game save data.
 type UserGameSave struct {
-	UserID          string `gorm:"primaryKey;type:char(26);not null"`
-	DeveloperGameID string `gorm:"primaryKey;type:char(26);not null"`
-	SaveSlot        uint8  `gorm:"not null;min:1;max:10"`
-	SaveData        string `gorm:"type:mediumtext"`
+	UserID          string  `gorm:"primaryKey;type:char(26);not null"`
+	DeveloperGameID string  `gorm:"primaryKey;type:char(26);not null"`
+	SaveSlot        uint8   `gorm:"primaryKey;autoIncrement:false;not null"`
+	SaveData        string  `gorm:"type:mediumtext"`
+	KeyVersion      uint16  `gorm:"not null;default:0"`
+	Size            uint32  `gorm:"not null;default:0"`  // Size of the unencrypted save data in bytes
+	StoredSize      uint32  `gorm:"not null;default:0"`  // Size of the save data after compression and encryption
+	Codec           uint8   `gorm:"not null;default:0"`  // How the save data was compressed before encryption, see saves.CodecNone
+	BlobKey         *string `gorm:"type:char(64);index"` // Set if SaveData is kept in the blob store instead
+	Revision        uint64  `gorm:"not null;default:1"`  // Incremented on every write, for optimistic concurrency
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
 
@@ -198,6 +350,27 @@ type UserGameSave struct {
 	DeveloperGame *DeveloperGame `gorm:"foreignKey:DeveloperGameID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// UserGameSaveRevision is a previous version of a UserGameSave, kept whenever a save is
+// overwritten or deleted so that it can be restored. SavedAt is when the version was written.
+type UserGameSaveRevision struct {
+	ID              string  `gorm:"primaryKey;type:char(26);not null"`
+	UserID          string  `gorm:"type:char(26);not null;index:idx_save_revision_slot"`
+	DeveloperGameID string  `gorm:"type:char(26);not null;index:idx_save_revision_slot"`
+	SaveSlot        uint8   `gorm:"not null;index:idx_save_revision_slot"`
+	SaveData        string  `gorm:"type:mediumtext"`
+	KeyVersion      uint16  `gorm:"not null;default:0"`
+	Size            uint32  `gorm:"not null;default:0"`
+	StoredSize      uint32  `gorm:"not null;default:0"`
+	Codec           uint8   `gorm:"not null;default:0"`
+	BlobKey         *string `gorm:"type:char(64);index"`
+	Revision        uint64  `gorm:"not null;default:1"`
+	SavedAt         time.Time
+	CreatedAt       time.Time `gorm:"index"`
+
+	User          *User          `gorm:"foreignKey:UserID;references:ID;constraint:OnDelete:CASCADE;"`
+	DeveloperGame *DeveloperGame `gorm:"foreignKey:DeveloperGameID;references:ID;constraint:OnDelete:CASCADE;"`
+}
+
 // Developer represents a game developer.
 type Developer struct {
 	ID          string             `gorm:"primaryKey;type:char(26);unique;not null"`
@@ -208,6 +381,7 @@ type Developer struct {
 	AvatarID    *string
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
 
 	Banner           *Image             `gorm:"foreignKey:BannerID;references:ID;constraint:OnDelete:SET NULL;"`
 	Avatar           *Image             `gorm:"foreignKey:AvatarID;references:ID;constraint:OnDelete:SET NULL;"`
@@ -223,6 +397,14 @@ type DeveloperGame struct {
 	State       bitfield.Bitfield8 `gorm:"not null;default:0;"`
 	ThumbnailID *string
 	CreatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+
+	// MaxSaveSlots is the number of save slots each user gets for this game.
+	MaxSaveSlots uint8 `gorm:"not null;default:10"`
+
+	// SaveQuota overrides the default limit on the bytes each user's saves for this game may
+	// take up. Zero uses the default.
+	SaveQuota int64 `gorm:"not null;default:0"`
 
 	Thumbnail     *Image          `gorm:"foreignKey:ThumbnailID;references:ID;constraint:OnDelete:SET NULL;"`
 	Developer     *Developer      `gorm:"foreignKey:DeveloperID;references:ID;constraint:OnDelete:CASCADE;"`
@@ -258,6 +440,18 @@ type DeveloperMember struct {
 	Developer *Developer `gorm:"foreignKey:DeveloperID;references:ID;constraint:OnDelete:CASCADE;"`
 }
 
+// LoginLockout blocks logins for a subject, either "user:<id>" or "ip:<address>", until
+// ExpiresAt. Lockouts are stored in the database so that they survive restarts and apply to
+// every backend instance. Count is the number of consecutive lockouts, used to grow the
+// lockout duration exponentially.
+type LoginLockout struct {
+	Subject   string `gorm:"primaryKey;type:varchar(255);not null"`
+	Count     uint16 `gorm:"not null;default:0"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
 // Image represents an image stored on the server's hosted folder.
 type Image struct {
 	ID        string `gorm:"primaryKey;type:char(26);unique;not null"`
@@ -0,0 +1,160 @@
+package types
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	UsernameMinLength = 1
+	UsernameMaxLength = 20
+	EmailMaxLength    = 255
+	SaveSlotMin       = 1
+	SaveSlotMax       = 100
+	DefaultSaveSlots  = 10
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-.]+$`)
+
+// ReservedUsernames cannot be claimed by users. Entries are lowercase.
+var ReservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"cloudlink":     true,
+	"deleted":       true,
+	"mod":           true,
+	"moderator":     true,
+	"null":          true,
+	"omega":         true,
+	"root":          true,
+	"server":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// ReservedUsernamePrefixes cannot start a username. "deleted_" is used for anonymized accounts.
+var ReservedUsernamePrefixes = []string{"deleted_"}
+
+// FieldError describes a validation failure on a single field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors is returned when one or more fields fail validation.
+type ValidationErrors []*FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// err returns nil if there are no errors, so that callers don't end up with a non-nil
+// error interface holding an empty slice.
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// NormalizeEmail trims surrounding whitespace and lowercases an email address.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Validate normalizes the user's email and checks the username and email constraints.
+// Failures are returned as ValidationErrors.
+func (u *User) Validate() error {
+	var errs ValidationErrors
+
+	length := utf8.RuneCountInString(u.Username)
+	switch {
+	case length < UsernameMinLength || length > UsernameMaxLength:
+		errs = append(errs, &FieldError{"Username", "length", fmt.Sprintf("must be between %d and %d characters", UsernameMinLength, UsernameMaxLength)})
+	case !usernamePattern.MatchString(u.Username):
+		errs = append(errs, &FieldError{"Username", "charset", "may only contain letters, numbers, '_', '-' and '.'"})
+	case isReservedUsername(u.Username):
+		errs = append(errs, &FieldError{"Username", "reserved", "is reserved"})
+	}
+
+	u.Email = NormalizeEmail(u.Email)
+	switch {
+	case u.Email == "":
+		errs = append(errs, &FieldError{"Email", "required", "is required"})
+	case len(u.Email) > EmailMaxLength:
+		errs = append(errs, &FieldError{"Email", "length", fmt.Sprintf("must be at most %d characters", EmailMaxLength)})
+	default:
+		if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+			errs = append(errs, &FieldError{"Email", "format", "is not a valid email address"})
+		}
+	}
+
+	return errs.err()
+}
+
+func isReservedUsername(username string) bool {
+	username = strings.ToLower(username)
+	if ReservedUsernames[username] {
+		return true
+	}
+	for _, prefix := range ReservedUsernamePrefixes {
+		if strings.HasPrefix(username, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the save slot is within bounds. maxSlots is the game's
+// MaxSaveSlots; zero only checks the global bounds.
+func (s *UserGameSave) Validate(maxSlots uint8) error {
+	if maxSlots == 0 || maxSlots > SaveSlotMax {
+		maxSlots = SaveSlotMax
+	}
+	var errs ValidationErrors
+	if s.SaveSlot < SaveSlotMin || s.SaveSlot > maxSlots {
+		errs = append(errs, &FieldError{"SaveSlot", "range", fmt.Sprintf("must be between %d and %d", SaveSlotMin, maxSlots)})
+	}
+	return errs.err()
+}
+
+// BeforeSave rejects save slots outside of the game's bounds before they reach the database.
+func (s *UserGameSave) BeforeSave(tx *gorm.DB) error {
+	var maxSlots []uint8
+	if err := tx.Session(&gorm.Session{NewDB: true}).Model(&DeveloperGame{}).
+		Where("id = ?", s.DeveloperGameID).
+		Pluck("max_save_slots", &maxSlots).Error; err != nil {
+		return err
+	}
+	if len(maxSlots) == 0 {
+		// The foreign key takes care of unknown games.
+		return s.Validate(0)
+	}
+	return s.Validate(maxSlots[0])
+}
+
+// Validate checks that the game's slot count is within the global bounds.
+func (g *DeveloperGame) Validate() error {
+	var errs ValidationErrors
+	if g.MaxSaveSlots < SaveSlotMin || g.MaxSaveSlots > SaveSlotMax {
+		errs = append(errs, &FieldError{"MaxSaveSlots", "range", fmt.Sprintf("must be between %d and %d", SaveSlotMin, SaveSlotMax)})
+	}
+	return errs.err()
+}
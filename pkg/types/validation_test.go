@@ -0,0 +1,96 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fieldCodes returns the "Field.code" of every error in err, which must be ValidationErrors.
+func fieldCodes(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("error %v is not ValidationErrors", err)
+	}
+	codes := make([]string, len(errs))
+	for i, e := range errs {
+		codes[i] = e.Field + "." + e.Code
+	}
+	return codes
+}
+
+func TestUserValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		email    string
+		want     string
+	}{
+		{"valid", "alice_1.b-c", "alice@example.com", ""},
+		{"longest username", strings.Repeat("a", UsernameMaxLength), "alice@example.com", ""},
+		{"empty username", "", "alice@example.com", "Username.length"},
+		{"long username", strings.Repeat("a", UsernameMaxLength+1), "alice@example.com", "Username.length"},
+		{"multibyte username", strings.Repeat("ä", UsernameMaxLength), "alice@example.com", "Username.charset"},
+		{"username with spaces", "alice b", "alice@example.com", "Username.charset"},
+		{"reserved username", "Admin", "alice@example.com", "Username.reserved"},
+		{"reserved prefix", "Deleted_alice", "alice@example.com", "Username.reserved"},
+		{"missing email", "alice", "  ", "Email.required"},
+		{"long email", "alice", strings.Repeat("a", EmailMaxLength) + "@example.com", "Email.length"},
+		{"invalid email", "alice", "alice@", "Email.format"},
+		{"email with a name", "alice", "Alice <alice@example.com>", "Email.format"},
+		{"both invalid", "admin", "alice", "Username.reserved,Email.format"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &User{Username: test.username, Email: test.email}
+			if got := strings.Join(fieldCodes(t, user.Validate()), ","); got != test.want {
+				t.Errorf("Validate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUserValidateNormalizesEmail(t *testing.T) {
+	user := &User{Username: "alice", Email: "  Alice@Example.COM "}
+	if err := user.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Errorf("Email = %q, want it trimmed and lowercased", user.Email)
+	}
+}
+
+func TestSaveSlotValidate(t *testing.T) {
+	tests := []struct {
+		slot     uint8
+		maxSlots uint8
+		valid    bool
+	}{
+		{0, 10, false},
+		{1, 10, true},
+		{10, 10, true},
+		{11, 10, false},
+		{SaveSlotMax, 0, true},
+		{SaveSlotMax + 1, 0, false},
+		{SaveSlotMax + 1, 255, false},
+	}
+	for _, test := range tests {
+		err := (&UserGameSave{SaveSlot: test.slot}).Validate(test.maxSlots)
+		if (err == nil) != test.valid {
+			t.Errorf("slot %d of %d: Validate() = %v, want valid %v", test.slot, test.maxSlots, err, test.valid)
+		}
+	}
+
+	for _, slots := range []uint8{0, SaveSlotMax + 1} {
+		if err := (&DeveloperGame{MaxSaveSlots: slots}).Validate(); err == nil {
+			t.Errorf("DeveloperGame with %d slots passed validation", slots)
+		}
+	}
+	if err := (&DeveloperGame{MaxSaveSlots: DefaultSaveSlots}).Validate(); err != nil {
+		t.Errorf("DeveloperGame with the default slots: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// TombstoneUsername returns the placeholder username given to an anonymized user. It is
+// unique per user and fits within types.UsernameMaxLength.
+func TombstoneUsername(id string) string {
+	suffix := strings.ToLower(id)
+	if len(suffix) > 12 {
+		suffix = suffix[len(suffix)-12:]
+	}
+	return "deleted_" + suffix
+}
+
+// IsTombstone reports whether the user has been anonymized.
+func IsTombstone(user *types.User) bool {
+	return user.Username == TombstoneUsername(user.ID)
+}
+
+// AnonymizeUser scrubs the personal data of a user while keeping the account row, so that
+// comments and reports stay attributed to a "deleted user" for moderation history.
+// A soft-deleted user is undeleted, since purging the row would take those along with it.
+// Every step runs in a single transaction and is recorded as a UserEvent.
+func (r *UserRepository) AnonymizeUser(id string) error {
+	var ended []string
+	if err := r.db.Transaction(func(tx *gorm.DB) error {
+		user := &types.User{}
+		if err := tx.Unscoped().Where("id = ?", id).First(user).Error; err != nil {
+			return translateError(err)
+		}
+
+		steps := []struct {
+			name string
+			run  func(tx *gorm.DB) error
+		}{
+			{"profile", func(tx *gorm.DB) error {
+				return tx.Unscoped().Model(user).Updates(map[string]any{
+					"username":   TombstoneUsername(user.ID),
+					"email":      strings.ToLower(user.ID) + "@deleted.invalid",
+					"password":   "",
+					"secret":     "",
+					"avatar_id":  nil,
+					"banner_id":  nil,
+					"deleted_at": nil,
+				}).Error
+			}},
+			{"passwords", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserPassword{}).Error
+			}},
+			{"sessions", func(tx *gorm.DB) error {
+				if err := tx.Model(&types.UserSession{}).Where("user_id = ?", user.ID).Pluck("id", &ended).Error; err != nil {
+					return err
+				}
+				return tx.Model(&types.UserSession{}).Where("user_id = ?", user.ID).Updates(map[string]any{
+					"ip":         "",
+					"user_agent": "",
+					"origin":     "",
+					"last_ip":    "",
+					"region":     nil,
+					"expires_at": time.Now(),
+				}).Error
+			}},
+			{"devices", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserDevice{}).Error
+			}},
+			{"oauth", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserIdentity{}).Error
+			}},
+			{"totp", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserTOTP{}).Error
+			}},
+			{"passkeys", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserWebAuthnCredential{}).Error
+			}},
+			{"recovery_codes", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.RecoveryCode{}).Error
+			}},
+			{"verifications", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.Verification{}).Error
+			}},
+			{"pending_email_change", func(tx *gorm.DB) error {
+				return tx.Where("user_id = ?", user.ID).Delete(&types.PendingEmailChange{}).Error
+			}},
+
+			// Saves can't be decrypted once the secret is gone, so there is no point in keeping them.
+			{"saves", func(tx *gorm.DB) error {
+				if err := tx.Where("user_id = ?", user.ID).Delete(&types.UserGameSaveRevision{}).Error; err != nil {
+					return err
+				}
+				return tx.Where("user_id = ?", user.ID).Delete(&types.UserGameSave{}).Error
+			}},
+		}
+
+		for _, step := range steps {
+			if err := step.run(tx); err != nil {
+				return err
+			}
+			if err := dbutil.LogUserEvent(tx, user.ID, "user_anonymize_step", step.name, true); err != nil {
+				return err
+			}
+		}
+
+		return dbutil.LogUserEvent(tx, user.ID, "user_anonymized", "", true)
+	}); err != nil {
+		return err
+	}
+	r.evictSessions(ended)
+	return nil
+}
@@ -0,0 +1,73 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func TestAnonymizeKeepsHistory(t *testing.T) {
+	db := dbtest.Open(t,
+		&types.User{}, &types.UserEvent{}, &types.UserPassword{}, &types.UserSession{},
+		&types.UserDevice{}, &types.UserIdentity{}, &types.UserTOTP{},
+		&types.UserWebAuthnCredential{}, &types.RecoveryCode{}, &types.Verification{},
+		&types.UserGameSave{}, &types.UserGameSaveRevision{}, &types.PendingEmailChange{},
+		&types.DeveloperGame{}, &types.GameComment{}, &types.UserReport{},
+	)
+	r := NewUserRepository(db)
+	for _, user := range []*types.User{
+		{ID: "alice", Username: "alice", Email: "alice@example.com"},
+		{ID: "bob", Username: "bob", Email: "bob@example.com"},
+	} {
+		if err := r.Create(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, row := range []any{
+		&types.Developer{ID: "dev"},
+		&types.DeveloperGame{ID: "game", DeveloperID: "dev"},
+		&types.GameComment{ID: "comment", UserID: "alice", DeveloperGameID: "game", Content: "hi"},
+		&types.UserReport{ID: "report", UserID: "bob", SubmittedUserID: "alice"},
+	} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := r.StartEmailChange("alice", "alice@example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SoftDelete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AnonymizeUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the cascade matters here, the event log has no seeded events to reference.
+	if err := db.Exec("PRAGMA foreign_keys = ON").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Purge(-time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := r.GetByID("alice")
+	if err != nil {
+		t.Fatalf("GetByID after Purge: %v", err)
+	}
+	if !IsTombstone(user) {
+		t.Errorf("username = %q, want a tombstone", user.Username)
+	}
+	var changes, comments, reports int64
+	db.Model(&types.PendingEmailChange{}).Where("user_id = ?", "alice").Count(&changes)
+	if changes != 0 {
+		t.Errorf("%d pending email changes left, want 0", changes)
+	}
+	db.Model(&types.GameComment{}).Where("user_id = ?", "alice").Count(&comments)
+	db.Model(&types.UserReport{}).Where("submitted_user_id = ?", "alice").Count(&reports)
+	if comments != 1 || reports != 1 {
+		t.Errorf("after Purge: %d comments and %d reports, want 1 and 1", comments, reports)
+	}
+}
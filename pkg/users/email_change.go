@@ -0,0 +1,229 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultEmailChangeTTL is how long the new address has to confirm a change.
+const DefaultEmailChangeTTL = 24 * time.Hour
+
+// EmailChangeRevertWindow is how long the old address can revert a completed change.
+const EmailChangeRevertWindow = 7 * 24 * time.Hour
+
+var (
+	ErrNoEmailChange      = errors.New("no pending email change")
+	ErrEmailChangeExpired = errors.New("email change has expired")
+	ErrInvalidEmailToken  = errors.New("invalid email change token")
+	ErrSameEmail          = errors.New("new email is the same as the current one")
+	ErrRevertWindowOpen   = errors.New("the previous email change can still be reverted")
+)
+
+// StartEmailChange begins changing the user's email to newEmail, replacing any pending change.
+// It returns one token to mail to the current address, for cancelling or reverting, and one to
+// mail to the new address, for confirming. Neither token is stored in plaintext.
+// While a completed change can still be reverted, it fails with ErrRevertWindowOpen, so that a
+// hijacker can't start another change to discard the owner's revert token.
+func (r *UserRepository) StartEmailChange(userID string, newEmail string, ttl time.Duration) (oldToken string, newToken string, err error) {
+	if ttl <= 0 {
+		ttl = DefaultEmailChangeTTL
+	}
+
+	user, err := r.GetByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Validate the new address with the same rules as a regular update.
+	candidate := *user
+	candidate.Email = newEmail
+	if err := candidate.Validate(); err != nil {
+		return "", "", err
+	}
+	if candidate.Email == types.NormalizeEmail(user.Email) {
+		return "", "", ErrSameEmail
+	}
+	if taken, err := r.emailTaken(r.db, candidate.Email, userID); err != nil {
+		return "", "", err
+	} else if taken {
+		return "", "", ErrEmailTaken
+	}
+
+	if oldToken, err = newEmailToken(); err != nil {
+		return "", "", err
+	}
+	if newToken, err = newEmailToken(); err != nil {
+		return "", "", err
+	}
+
+	change := &types.PendingEmailChange{
+		UserID:       userID,
+		OldEmail:     user.Email,
+		NewEmail:     candidate.Email,
+		OldTokenHash: hashEmailToken(oldToken),
+		NewTokenHash: hashEmailToken(newToken),
+		ExpiresAt:    time.Now().Add(ttl),
+	}
+	if err := r.db.Transaction(func(tx *gorm.DB) error {
+		previous, err := lockEmailChange(tx, userID)
+		if err != nil && !errors.Is(err, ErrNoEmailChange) {
+			return err
+		}
+		if previous != nil {
+			if previous.CompletedAt != nil && previous.RevertUntil != nil && time.Now().Before(*previous.RevertUntil) {
+				return ErrRevertWindowOpen
+			}
+			if err := tx.Delete(previous).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(change).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_email_change_started", "", true)
+	}); err != nil {
+		return "", "", err
+	}
+	return oldToken, newToken, nil
+}
+
+// ConfirmEmailChange finishes a pending change using the token sent to the new address. The
+// email is swapped in a transaction that re-checks that no one else has claimed it meanwhile.
+func (r *UserRepository) ConfirmEmailChange(userID string, newToken string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		change, err := lockEmailChange(tx, userID)
+		if err != nil {
+			return err
+		}
+		if change.CompletedAt != nil {
+			return ErrNoEmailChange
+		}
+		if !time.Now().Before(change.ExpiresAt) {
+			return ErrEmailChangeExpired
+		}
+		if !checkEmailToken(newToken, change.NewTokenHash) {
+			return ErrInvalidEmailToken
+		}
+
+		if err := r.swapEmail(tx, userID, change.OldEmail, change.NewEmail); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		revertUntil := now.Add(EmailChangeRevertWindow)
+		if err := tx.Model(change).Updates(map[string]any{
+			"completed_at": now,
+			"revert_until": revertUntil,
+		}).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_email_changed", "", true)
+	})
+}
+
+// RevertEmailChange uses the token sent to the old address to cancel a pending change, or to
+// restore the old address if the change completed less than EmailChangeRevertWindow ago.
+func (r *UserRepository) RevertEmailChange(userID string, oldToken string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		change, err := lockEmailChange(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !checkEmailToken(oldToken, change.OldTokenHash) {
+			return ErrInvalidEmailToken
+		}
+
+		if change.CompletedAt == nil {
+			if err := tx.Delete(change).Error; err != nil {
+				return err
+			}
+			return dbutil.LogUserEvent(tx, userID, "user_email_change_cancelled", "", true)
+		}
+
+		if change.RevertUntil == nil || !time.Now().Before(*change.RevertUntil) {
+			return ErrEmailChangeExpired
+		}
+		if err := r.swapEmail(tx, userID, change.NewEmail, change.OldEmail); err != nil {
+			return err
+		}
+		if err := tx.Delete(change).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_email_change_reverted", "", true)
+	})
+}
+
+// CleanupEmailChanges deletes pending changes that expired unconfirmed, and completed ones
+// whose revert window has passed.
+func (r *UserRepository) CleanupEmailChanges() (int64, error) {
+	now := time.Now()
+	result := r.db.Where(
+		"(completed_at IS NULL AND expires_at <= ?) OR (completed_at IS NOT NULL AND revert_until <= ?)", now, now,
+	).Delete(&types.PendingEmailChange{})
+	return result.RowsAffected, result.Error
+}
+
+// swapEmail changes the user's email from one address to another. The update is guarded on the
+// current address, so a concurrent change makes it fail instead of being overwritten.
+func (r *UserRepository) swapEmail(tx *gorm.DB, userID string, from string, to string) error {
+	if taken, err := r.emailTaken(tx, to, userID); err != nil {
+		return err
+	} else if taken {
+		return ErrEmailTaken
+	}
+
+	result := tx.Model(&types.User{}).Where("id = ? AND email = ?", userID, from).Update("email", to)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoEmailChange
+	}
+	return nil
+}
+
+// emailTaken reports whether another user, including soft-deleted ones, holds the address.
+func (r *UserRepository) emailTaken(tx *gorm.DB, email string, userID string) (bool, error) {
+	var count int64
+	err := tx.Unscoped().Model(&types.User{}).Where("LOWER(email) = ? AND id <> ?", strings.ToLower(email), userID).Count(&count).Error
+	return count > 0, err
+}
+
+func lockEmailChange(tx *gorm.DB, userID string) (*types.PendingEmailChange, error) {
+	change := &types.PendingEmailChange{}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).First(change).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoEmailChange
+		}
+		return nil, err
+	}
+	return change, nil
+}
+
+func newEmailToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashEmailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkEmailToken(token string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashEmailToken(token)), []byte(hash)) == 1
+}
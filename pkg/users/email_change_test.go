@@ -0,0 +1,121 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func newTestRepository(t *testing.T) *UserRepository {
+	db := dbtest.Open(t, &types.User{}, &types.PendingEmailChange{}, &types.UserEvent{})
+	r := NewUserRepository(db)
+	for _, user := range []*types.User{
+		{ID: "alice", Username: "alice", Email: "alice@example.com"},
+		{ID: "bob", Username: "bob", Email: "bob@example.com"},
+	} {
+		if err := r.Create(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func email(t *testing.T, r *UserRepository, userID string) string {
+	t.Helper()
+	user, err := r.GetByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Email
+}
+
+func TestStartEmailChange(t *testing.T) {
+	r := newTestRepository(t)
+	tests := []struct {
+		name     string
+		newEmail string
+		want     error
+	}{
+		{"same address", "Alice@Example.com", ErrSameEmail},
+		{"taken address", "bob@example.com", ErrEmailTaken},
+		{"new address", "alice@example.org", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := r.StartEmailChange("alice", test.newEmail, 0)
+			if !errors.Is(err, test.want) {
+				t.Errorf("StartEmailChange(%q) = %v, want %v", test.newEmail, err, test.want)
+			}
+		})
+	}
+}
+
+func TestEmailChangeRevertWindow(t *testing.T) {
+	r := newTestRepository(t)
+	oldToken, newToken, err := r.StartEmailChange("alice", "alice@example.org", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ConfirmEmailChange("alice", oldToken); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("confirming with the old token = %v, want ErrInvalidEmailToken", err)
+	}
+	if err := r.ConfirmEmailChange("alice", newToken); err != nil {
+		t.Fatal(err)
+	}
+	if got := email(t, r, "alice"); got != "alice@example.org" {
+		t.Fatalf("email after confirming = %q", got)
+	}
+
+	// Another change would replace the completed one and with it the owner's revert token.
+	if _, _, err := r.StartEmailChange("alice", "alice@example.net", 0); !errors.Is(err, ErrRevertWindowOpen) {
+		t.Fatalf("starting a change during the revert window = %v, want ErrRevertWindowOpen", err)
+	}
+	if err := r.RevertEmailChange("alice", oldToken); err != nil {
+		t.Fatalf("reverting after a refused change: %v", err)
+	}
+	if got := email(t, r, "alice"); got != "alice@example.com" {
+		t.Fatalf("email after reverting = %q", got)
+	}
+
+	// Once reverted, or once the window has passed, a new change can start.
+	if _, newToken, err = r.StartEmailChange("alice", "alice@example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ConfirmEmailChange("alice", newToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Model(&types.PendingEmailChange{}).Where("user_id = ?", "alice").Update("revert_until", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.StartEmailChange("alice", "alice@example.net", 0); err != nil {
+		t.Errorf("starting a change after the revert window: %v", err)
+	}
+}
+
+func TestCancelEmailChange(t *testing.T) {
+	r := newTestRepository(t)
+	oldToken, newToken, err := r.StartEmailChange("alice", "alice@example.org", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pending change can be replaced, which invalidates its tokens.
+	oldToken2, _, err := r.StartEmailChange("alice", "alice@example.net", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RevertEmailChange("alice", oldToken); !errors.Is(err, ErrInvalidEmailToken) {
+		t.Errorf("cancelling with a replaced token = %v, want ErrInvalidEmailToken", err)
+	}
+	if err := r.RevertEmailChange("alice", oldToken2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ConfirmEmailChange("alice", newToken); !errors.Is(err, ErrNoEmailChange) {
+		t.Errorf("confirming a cancelled change = %v, want ErrNoEmailChange", err)
+	}
+	if got := email(t, r, "alice"); got != "alice@example.com" {
+		t.Errorf("email after cancelling = %q", got)
+	}
+}
@@ -0,0 +1,66 @@
+package users
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotFound      = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username is already taken")
+	ErrEmailTaken    = errors.New("email is already in use")
+)
+
+// uniqueKeys maps the unique constraints of the users table onto the errors for them. Tables
+// created by older versions of GORM named the constraints after their column.
+var uniqueKeys = map[string]error{
+	"uni_users_username": ErrUsernameTaken,
+	"username":           ErrUsernameTaken,
+	"uni_users_email":    ErrEmailTaken,
+	"email":              ErrEmailTaken,
+}
+
+// translateError maps driver-specific errors onto the typed errors of this package.
+// Unique constraint failures are detected by message, since the storage module does not
+// depend on any particular driver.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+
+	if !dbutil.IsUniqueViolation(err) {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	if translated, ok := uniqueKeys[violatedKey(msg)]; ok {
+		return translated
+	}
+	return err
+}
+
+// violatedKey extracts the name of the violated constraint from a lowercased unique
+// constraint failure, without any table prefix. The message may also contain the duplicate
+// value, so only the part naming the constraint is looked at.
+func violatedKey(msg string) string {
+	var key string
+	switch {
+	case strings.Contains(msg, "for key '"): // MySQL, MariaDB: ... for key 'users.email'
+		key = msg[strings.LastIndex(msg, "for key '")+len("for key '"):]
+		key, _, _ = strings.Cut(key, "'")
+	case strings.Contains(msg, "unique constraint \""): // PostgreSQL: ... unique constraint "uni_users_email"
+		key = msg[strings.Index(msg, "unique constraint \"")+len("unique constraint \""):]
+		key, _, _ = strings.Cut(key, "\"")
+	case strings.Contains(msg, "unique constraint failed: "): // SQLite: ... failed: users.email
+		key = msg[strings.Index(msg, "unique constraint failed: ")+len("unique constraint failed: "):]
+		key, _, _ = strings.Cut(key, ",")
+	}
+	key = strings.TrimSpace(key)
+	return key[strings.LastIndex(key, ".")+1:]
+}
@@ -0,0 +1,38 @@
+package users
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestTranslateError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"not found", gorm.ErrRecordNotFound, ErrNotFound},
+		{"mysql username", errors.New("Error 1062 (23000): Duplicate entry 'alice' for key 'users.uni_users_username'"), ErrUsernameTaken},
+		{"mysql email", errors.New("Error 1062 (23000): Duplicate entry 'alice@example.com' for key 'users.uni_users_email'"), ErrEmailTaken},
+		{"mysql email containing username", errors.New("Error 1062 (23000): Duplicate entry 'username@example.com' for key 'users.email'"), ErrEmailTaken},
+		{"mysql username containing email", errors.New("Error 1062 (23000): Duplicate entry 'email' for key 'username'"), ErrUsernameTaken},
+		{"postgres email", errors.New(`ERROR: duplicate key value violates unique constraint "uni_users_email" (SQLSTATE 23505)`), ErrEmailTaken},
+		{"sqlite username", errors.New("UNIQUE constraint failed: users.username"), ErrUsernameTaken},
+		{"other constraint", errors.New("Error 1062 (23000): Duplicate entry 'username' for key 'users.PRIMARY'"), nil},
+		{"other error", errors.New("connection refused"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := translateError(test.err)
+			want := test.want
+			if want == nil {
+				want = test.err
+			}
+			if got != want {
+				t.Errorf("translateError(%q) = %v, want %v", test.err, got, want)
+			}
+		})
+	}
+}
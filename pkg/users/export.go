@@ -0,0 +1,340 @@
+package users
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// ExportVersion is bumped whenever the layout of an export bundle changes.
+const ExportVersion = 3
+
+// SaveSource returns a user's saves and save revisions with their data decrypted.
+// *saves.SaveRepository implements it, since it knows where and how save data is kept.
+type SaveSource interface {
+	ExportSaves(userID string) ([]*types.UserGameSave, []*types.UserGameSaveRevision, error)
+}
+
+// ExportManifest is written as manifest.json and lists the other files in the bundle.
+type ExportManifest struct {
+	Version    int            `json:"version"`
+	UserID     string         `json:"user_id"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Files      map[string]int `json:"files"`
+}
+
+type exportedUser struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	State     uint8     `json:"state"`
+	AvatarID  *string   `json:"avatar_id"`
+	BannerID  *string   `json:"banner_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type exportedEmailChange struct {
+	OldEmail    string     `json:"old_email"`
+	NewEmail    string     `json:"new_email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	RevertUntil *time.Time `json:"revert_until"`
+}
+
+type exportedSession struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	Origin    string    `json:"origin"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	Browser     string    `json:"browser"`
+	OS          string    `json:"os"`
+	DeviceClass string    `json:"device_class"`
+	Region      *string   `json:"region"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	LastIP      string    `json:"last_ip"`
+}
+
+type exportedDevice struct {
+	Browser     string    `json:"browser"`
+	OS          string    `json:"os"`
+	DeviceClass string    `json:"device_class"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+type exportedLink struct {
+	Provider    string    `json:"provider"`
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportedEvent struct {
+	EventID    string    `json:"event_id"`
+	Details    string    `json:"details"`
+	Successful bool      `json:"successful"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type exportedSave struct {
+	DeveloperGameID string    `json:"developer_game_id"`
+	SaveSlot        uint8     `json:"save_slot"`
+	SaveData        string    `json:"save_data"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type exportedSaveRevision struct {
+	ID              string    `json:"id"`
+	DeveloperGameID string    `json:"developer_game_id"`
+	SaveSlot        uint8     `json:"save_slot"`
+	Revision        uint64    `json:"revision"`
+	SaveData        string    `json:"save_data"`
+	SavedAt         time.Time `json:"saved_at"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type exportedComment struct {
+	ID              string    `json:"id"`
+	DeveloperGameID string    `json:"developer_game_id"`
+	ParentID        *string   `json:"parent_id"`
+	Content         string    `json:"content"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type exportedAchievement struct {
+	ID              string    `json:"id"`
+	DeveloperGameID string    `json:"developer_game_id"`
+	Description     string    `json:"description"`
+	Points          uint64    `json:"points"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type exportedMembership struct {
+	DeveloperID string `json:"developer_id"`
+	State       uint8  `json:"state"`
+}
+
+type exportedReport struct {
+	Kind        string    `json:"kind"`
+	ID          string    `json:"id"`
+	TargetID    string    `json:"target_id"`
+	ReportTagID *string   `json:"report_tag_id"`
+	Details     string    `json:"details"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Export writes a zip bundle of everything stored about the user with the given ID to w.
+// Each kind of record is written as its own JSON file, and manifest.json lists them all.
+// Passwords, secrets, TOTP seeds and token hashes are never included.
+func (r *UserRepository) Export(id string, source SaveSource, w io.Writer) error {
+	user := &types.User{}
+	if err := r.db.Unscoped().Where("id = ?", id).First(user).Error; err != nil {
+		return translateError(err)
+	}
+
+	files, err := r.collectExport(user, source)
+	if err != nil {
+		return err
+	}
+
+	manifest := &ExportManifest{
+		Version:    ExportVersion,
+		UserID:     user.ID,
+		ExportedAt: time.Now().UTC(),
+		Files:      map[string]int{},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		manifest.Files[file.name] = file.count
+		if err := writeJSON(archive, file.name, file.data); err != nil {
+			return err
+		}
+	}
+	if err := writeJSON(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+type exportFile struct {
+	name  string
+	count int
+	data  any
+}
+
+func (r *UserRepository) collectExport(user *types.User, source SaveSource) ([]*exportFile, error) {
+	db := r.db
+	files := []*exportFile{{"user.json", 1, &exportedUser{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		State:     uint8(user.State),
+		AvatarID:  user.AvatarID,
+		BannerID:  user.BannerID,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}}}
+
+	var changes []*types.PendingEmailChange
+	if err := db.Where("user_id = ?", user.ID).Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	exportedChanges := make([]*exportedEmailChange, len(changes))
+	for i, c := range changes {
+		exportedChanges[i] = &exportedEmailChange{c.OldEmail, c.NewEmail, c.CreatedAt, c.ExpiresAt, c.CompletedAt, c.RevertUntil}
+	}
+	files = append(files, &exportFile{"pending_email_change.json", len(exportedChanges), exportedChanges})
+
+	var sessions []*types.UserSession
+	if err := db.Where("user_id = ?", user.ID).Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	exportedSessions := make([]*exportedSession, len(sessions))
+	for i, s := range sessions {
+		exportedSessions[i] = &exportedSession{
+			s.ID, s.UserAgent, s.Origin, s.IP, s.CreatedAt, s.UpdatedAt, s.ExpiresAt,
+			s.Browser, s.OS, s.DeviceClass, s.Region, s.LastSeenAt, s.LastIP,
+		}
+	}
+	files = append(files, &exportFile{"sessions.json", len(exportedSessions), exportedSessions})
+
+	var devices []*types.UserDevice
+	if err := db.Where("user_id = ?", user.ID).Order("first_seen_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	exportedDevices := make([]*exportedDevice, len(devices))
+	for i, d := range devices {
+		exportedDevices[i] = &exportedDevice{d.Browser, d.OS, d.DeviceClass, d.FirstSeenAt, d.LastSeenAt}
+	}
+	files = append(files, &exportFile{"devices.json", len(exportedDevices), exportedDevices})
+
+	var identities []*types.UserIdentity
+	if err := db.Where("user_id = ?", user.ID).Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	links := make([]*exportedLink, len(identities))
+	for i, l := range identities {
+		links[i] = &exportedLink{l.Provider, l.ProviderUserID, l.Email, l.DisplayName, l.CreatedAt}
+	}
+	files = append(files, &exportFile{"oauth_links.json", len(links), links})
+
+	var events []*types.UserEvent
+	if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	exportedEvents := make([]*exportedEvent, len(events))
+	for i, e := range events {
+		exportedEvents[i] = &exportedEvent{e.EventID, e.Details, e.Successful, e.CreatedAt}
+	}
+	files = append(files, &exportFile{"events.json", len(exportedEvents), exportedEvents})
+
+	gameSaves, revisions, err := source.ExportSaves(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	exportedSaves := make([]*exportedSave, len(gameSaves))
+	for i, s := range gameSaves {
+		exportedSaves[i] = &exportedSave{s.DeveloperGameID, s.SaveSlot, s.SaveData, s.CreatedAt, s.UpdatedAt}
+	}
+	files = append(files, &exportFile{"saves.json", len(exportedSaves), exportedSaves})
+
+	exportedRevisions := make([]*exportedSaveRevision, len(revisions))
+	for i, s := range revisions {
+		exportedRevisions[i] = &exportedSaveRevision{s.ID, s.DeveloperGameID, s.SaveSlot, s.Revision, s.SaveData, s.SavedAt, s.CreatedAt}
+	}
+	files = append(files, &exportFile{"save_revisions.json", len(exportedRevisions), exportedRevisions})
+
+	var comments []*types.GameComment
+	if err := db.Where("user_id = ?", user.ID).Find(&comments).Error; err != nil {
+		return nil, err
+	}
+	exportedComments := make([]*exportedComment, len(comments))
+	for i, c := range comments {
+		exportedComments[i] = &exportedComment{c.ID, c.DeveloperGameID, c.ParentID, c.Content, c.CreatedAt, c.UpdatedAt}
+	}
+	files = append(files, &exportFile{"comments.json", len(exportedComments), exportedComments})
+
+	var achievements []*types.Achievement
+	if err := db.Where("user_id = ?", user.ID).Find(&achievements).Error; err != nil {
+		return nil, err
+	}
+	exportedAchievements := make([]*exportedAchievement, len(achievements))
+	for i, a := range achievements {
+		exportedAchievements[i] = &exportedAchievement{a.ID, a.DeveloperGameID, a.Description, a.Points, a.CreatedAt}
+	}
+	files = append(files, &exportFile{"achievements.json", len(exportedAchievements), exportedAchievements})
+
+	var memberships []*types.DeveloperMember
+	if err := db.Where("user_id = ?", user.ID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	exportedMemberships := make([]*exportedMembership, len(memberships))
+	for i, m := range memberships {
+		exportedMemberships[i] = &exportedMembership{m.DeveloperID, uint8(m.State)}
+	}
+	files = append(files, &exportFile{"developer_memberships.json", len(exportedMemberships), exportedMemberships})
+
+	reports, err := collectReports(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, &exportFile{"reports.json", len(reports), reports})
+
+	return files, nil
+}
+
+// collectReports gathers the reports submitted by the user. Reports filed against the user
+// are left out, since they contain other people's data.
+func collectReports(db *gorm.DB, userID string) ([]*exportedReport, error) {
+	reports := []*exportedReport{}
+
+	var userReports []*types.UserReport
+	if err := db.Where("submitted_user_id = ?", userID).Find(&userReports).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range userReports {
+		reports = append(reports, &exportedReport{"user", r.ID, r.UserID, r.ReportTagID, r.Details, r.CreatedAt})
+	}
+
+	var developerReports []*types.DeveloperReport
+	if err := db.Where("submitted_user_id = ?", userID).Find(&developerReports).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range developerReports {
+		reports = append(reports, &exportedReport{"developer", r.ID, r.DeveloperID, r.ReportTagID, r.Details, r.CreatedAt})
+	}
+
+	var gameReports []*types.DeveloperGameReport
+	if err := db.Where("submitted_user_id = ?", userID).Find(&gameReports).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range gameReports {
+		reports = append(reports, &exportedReport{"game", r.ID, r.DeveloperGameID, r.ReportTagID, r.Details, r.CreatedAt})
+	}
+
+	return reports, nil
+}
+
+func writeJSON(archive *zip.Writer, name string, data any) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
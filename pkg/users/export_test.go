@@ -0,0 +1,88 @@
+package users
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+type testSaveSource struct {
+	saves     []*types.UserGameSave
+	revisions []*types.UserGameSaveRevision
+}
+
+func (s *testSaveSource) ExportSaves(userID string) ([]*types.UserGameSave, []*types.UserGameSaveRevision, error) {
+	return s.saves, s.revisions, nil
+}
+
+func TestExport(t *testing.T) {
+	r := newTestRepository(t)
+	if err := r.db.AutoMigrate(&types.UserSession{}, &types.UserDevice{}, &types.UserIdentity{}, &types.GameComment{}, &types.Achievement{},
+		&types.DeveloperMember{}, &types.UserReport{}, &types.DeveloperReport{}, &types.DeveloperGameReport{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.StartEmailChange("alice", "alice@example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.db.Create(&types.UserDevice{UserID: "alice", Browser: "Firefox", OS: "Linux", DeviceClass: "desktop"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	source := &testSaveSource{
+		saves:     []*types.UserGameSave{{UserID: "alice", DeveloperGameID: "game", SaveSlot: 1, SaveData: "current", Revision: 2}},
+		revisions: []*types.UserGameSaveRevision{{ID: "revision", UserID: "alice", DeveloperGameID: "game", SaveSlot: 1, SaveData: "previous", Revision: 1}},
+	}
+
+	var buf bytes.Buffer
+	if err := r.Export("alice", source, &buf); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest ExportManifest
+	readJSON(t, archive, "manifest.json", &manifest)
+	if manifest.Version != ExportVersion || manifest.UserID != "alice" {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	if manifest.Files["saves.json"] != 1 || manifest.Files["save_revisions.json"] != 1 {
+		t.Errorf("manifest files = %v, want one save and one revision", manifest.Files)
+	}
+
+	var saves []*exportedSave
+	readJSON(t, archive, "saves.json", &saves)
+	if len(saves) != 1 || saves[0].SaveData != "current" {
+		t.Errorf("exported saves = %+v", saves)
+	}
+	var revisions []*exportedSaveRevision
+	readJSON(t, archive, "save_revisions.json", &revisions)
+	if len(revisions) != 1 || revisions[0].SaveData != "previous" || revisions[0].Revision != 1 {
+		t.Errorf("exported revisions = %+v", revisions)
+	}
+	var devices []*exportedDevice
+	readJSON(t, archive, "devices.json", &devices)
+	if len(devices) != 1 || devices[0].Browser != "Firefox" {
+		t.Errorf("exported devices = %+v", devices)
+	}
+	var changes []*exportedEmailChange
+	readJSON(t, archive, "pending_email_change.json", &changes)
+	if len(changes) != 1 || changes[0].NewEmail != "alice@example.org" {
+		t.Errorf("exported email changes = %+v", changes)
+	}
+}
+
+func readJSON(t *testing.T, archive *zip.Reader, name string, v any) {
+	t.Helper()
+	f, err := archive.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
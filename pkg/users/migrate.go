@@ -0,0 +1,74 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+)
+
+// FitUsername shortens a username to types.UsernameMaxLength, replacing its end with part of
+// the user's ID so that shortened names stay unique. Usernames that fit are returned as is.
+func FitUsername(username string, id string) string {
+	if utf8.RuneCountInString(username) <= types.UsernameMaxLength {
+		return username
+	}
+	suffix := strings.ToLower(id)
+	if len(suffix) > 6 {
+		suffix = suffix[len(suffix)-6:]
+	}
+	suffix = "_" + suffix
+	return string([]rune(username)[:types.UsernameMaxLength-len(suffix)]) + suffix
+}
+
+// MigrateUserFieldLengths prepares existing users for the username and email column sizes,
+// and must run before AutoMigrate. Legacy usernames came from a tinytext column, so longer
+// ones are shortened with FitUsername and every rename is logged. Emails that don't fit can't
+// be shortened without losing the address, so they are reported and the migration fails.
+func MigrateUserFieldLengths(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&types.User{}) {
+		return nil
+	}
+
+	renames := map[string]string{}
+	var overlongEmails []string
+	var batch []*types.User
+	if err := db.Unscoped().Select("id", "username", "email").
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for _, user := range batch {
+				if fitted := FitUsername(user.Username, user.ID); fitted != user.Username {
+					renames[user.ID] = fitted
+				}
+				if utf8.RuneCountInString(user.Email) > types.EmailMaxLength {
+					overlongEmails = append(overlongEmails, user.ID)
+				}
+			}
+			return nil
+		}).Error; err != nil {
+		return err
+	}
+	if len(overlongEmails) > 0 {
+		return fmt.Errorf("users with emails longer than %d characters must be fixed before migrating: %s", types.EmailMaxLength, strings.Join(overlongEmails, ", "))
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		for id, username := range renames {
+			if err := tx.Unscoped().Model(&types.User{}).Where("id = ?", id).Update("username", username).Error; err != nil {
+				return fmt.Errorf("shortening the username of user %s: %w", id, err)
+			}
+			log.Warn("Shortened the username of user ", id, " to ", username, ".")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info("Shortened ", len(renames), " usernames that were too long.")
+	return nil
+}
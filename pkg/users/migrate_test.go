@@ -0,0 +1,74 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func TestFitUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		id       string
+		want     string
+	}{
+		{"alice", "01HZY3M6K8QW", "alice"},
+		{"twenty_characters_x", "01HZY3M6K8QW", "twenty_characters_x"},
+		{"a_very_long_legacy_username", "01HZY3M6K8QW", "a_very_long_l_m6k8qw"},
+		{"ünïcödé_ünïcödé_ünïcödé", "01HZY3M6K8QW", "ünïcödé_ünïcö_m6k8qw"},
+	}
+	for _, test := range tests {
+		got := FitUsername(test.username, test.id)
+		if got != test.want {
+			t.Errorf("FitUsername(%q) = %q, want %q", test.username, got, test.want)
+		}
+		if utf8.RuneCountInString(got) > types.UsernameMaxLength {
+			t.Errorf("FitUsername(%q) = %q, which is too long", test.username, got)
+		}
+	}
+}
+
+func TestMigrateUserFieldLengths(t *testing.T) {
+	db := dbtest.Open(t, &types.User{})
+	long := strings.Repeat("x", 30)
+	users := []*types.User{
+		{ID: "01HZY3M6K8QW", Username: long + "a", Email: "long@example.com"},
+		{ID: "01HZY3M6K8QX", Username: long + "b", Email: "other@example.com"},
+		{ID: "01HZY3M6K8QY", Username: "short", Email: "short@example.com"},
+	}
+	if err := db.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(users[1]).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateUserFieldLengths(db); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"01HZY3M6K8QW": "xxxxxxxxxxxxx_m6k8qw",
+		"01HZY3M6K8QX": "xxxxxxxxxxxxx_m6k8qx",
+		"01HZY3M6K8QY": "short",
+	}
+	for id, username := range want {
+		user := &types.User{}
+		if err := db.Unscoped().Where("id = ?", id).First(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != username {
+			t.Errorf("user %s is named %q, want %q", id, user.Username, username)
+		}
+	}
+
+	// Emails can't be shortened, so they stop the migration.
+	if err := db.Create(&types.User{ID: "01HZY3M6K8QZ", Username: "email", Email: strings.Repeat("x", 250) + "@example.com"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateUserFieldLengths(db); err == nil || !strings.Contains(err.Error(), "01HZY3M6K8QZ") {
+		t.Errorf("MigrateUserFieldLengths with a long email = %v, want an error naming the user", err)
+	}
+}
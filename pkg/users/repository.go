@@ -0,0 +1,185 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/sessions"
+	"github.com/cloudlink-omega/storage/pkg/softdelete"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// DefaultPageSize is used by List when a non-positive page size is given.
+const DefaultPageSize = 50
+
+// MaxPageSize caps the number of users returned by a single List call.
+const MaxPageSize = 500
+
+// UserRepository wraps the common lookups on types.User so that the backend, accounts and
+// signaling services don't need to re-implement them.
+type UserRepository struct {
+	db       *gorm.DB
+	sessions *sessions.SessionStore
+}
+
+func NewUserRepository(db *gorm.DB) *UserRepository {
+	if db == nil {
+		panic("Got nil database")
+	}
+	return &UserRepository{db: db}
+}
+
+// SetSessionStore lets the repository evict the cached sessions of users whose sessions it
+// ends. Without it, those sessions stay valid until their cache entries expire.
+func (r *UserRepository) SetSessionStore(store *sessions.SessionStore) {
+	r.sessions = store
+}
+
+// Create validates and inserts a new user. If the user has no ID, a new ULID is assigned.
+func (r *UserRepository) Create(user *types.User) error {
+	if err := user.Validate(); err != nil {
+		return err
+	}
+	if user.ID == "" {
+		user.ID = ulid.Make().String()
+	}
+	if err := r.db.Create(user).Error; err != nil {
+		return r.conflict(user, err)
+	}
+	return nil
+}
+
+// GetByID returns the user with the given ID.
+func (r *UserRepository) GetByID(id string) (*types.User, error) {
+	user := &types.User{}
+	if err := r.db.Where("id = ?", id).First(user).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return user, nil
+}
+
+// GetByUsername returns the user with the given username.
+func (r *UserRepository) GetByUsername(username string) (*types.User, error) {
+	user := &types.User{}
+	if err := r.db.Where("username = ?", username).First(user).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return user, nil
+}
+
+// GetByEmail returns the user with the given email. The comparison is case-insensitive.
+func (r *UserRepository) GetByEmail(email string) (*types.User, error) {
+	user := &types.User{}
+	if err := r.db.Where("LOWER(email) = ?", strings.ToLower(email)).First(user).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return user, nil
+}
+
+// Update validates and saves all fields of an existing user.
+func (r *UserRepository) Update(user *types.User) error {
+	if err := user.Validate(); err != nil {
+		return err
+	}
+	result := r.db.Model(user).Select("*").Omit("CreatedAt", "DeletedAt").Updates(user)
+	if result.Error != nil {
+		return r.conflict(user, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SoftDelete marks the user with the given ID as deleted and ends all of their sessions.
+// The row is kept until it is purged, so the account can be restored in the meantime.
+func (r *UserRepository) SoftDelete(id string) error {
+	var ended []string
+	if err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ?", id).Delete(&types.User{})
+		if result.Error != nil {
+			return translateError(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if err := tx.Model(&types.UserSession{}).Where("user_id = ?", id).Pluck("id", &ended).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", id).Delete(&types.UserSession{}).Error
+	}); err != nil {
+		return err
+	}
+	r.evictSessions(ended)
+	return nil
+}
+
+// evictSessions drops ended sessions from the session cache. It must only be called after
+// the transaction that ended them has committed, so that they can't be cached again.
+func (r *UserRepository) evictSessions(ids []string) {
+	if r.sessions != nil {
+		r.sessions.Evict(ids...)
+	}
+}
+
+// Restore undoes a SoftDelete if it happened less than window ago.
+func (r *UserRepository) Restore(id string, window time.Duration) error {
+	err := softdelete.Restore(r.db, &types.User{}, id, window)
+	if errors.Is(err, softdelete.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Purge hard-deletes users that were soft-deleted more than window ago, along with
+// everything that references them. Their usernames and emails can be claimed again afterwards.
+func (r *UserRepository) Purge(window time.Duration) (int64, error) {
+	return softdelete.Purge(r.db, &types.User{}, window)
+}
+
+// List returns a page of users ordered by ID, along with the total number of users.
+// Pages start at 1.
+func (r *UserRepository) List(page int, pageSize int) ([]*types.User, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+
+	var total int64
+	if err := r.db.Model(&types.User{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []*types.User
+	if err := r.db.Order("id").Limit(pageSize).Offset((page - 1) * pageSize).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// conflict translates a write error. When the driver error doesn't say which column
+// caused a unique violation (e.g. with gorm's TranslateError enabled), the database is
+// probed to find out. Soft-deleted users still hold their username and email until purged.
+func (r *UserRepository) conflict(user *types.User, err error) error {
+	translated := translateError(err)
+	if !errors.Is(translated, gorm.ErrDuplicatedKey) {
+		return translated
+	}
+
+	var count int64
+	if r.db.Unscoped().Model(&types.User{}).Where("username = ? AND id <> ?", user.Username, user.ID).Count(&count).Error == nil && count > 0 {
+		return ErrUsernameTaken
+	}
+	if r.db.Unscoped().Model(&types.User{}).Where("LOWER(email) = ? AND id <> ?", strings.ToLower(user.Email), user.ID).Count(&count).Error == nil && count > 0 {
+		return ErrEmailTaken
+	}
+	return translated
+}
@@ -0,0 +1,169 @@
+package verification
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbutil"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PurposeEmailVerify     = "email_verify"
+	PurposePasswordReset   = "password_reset"
+	PurposeEmailChange     = "email_change"
+	PurposeAccountDeletion = "account_deletion"
+)
+
+// DefaultTTL is how long a code stays valid when no TTL is given.
+const DefaultTTL = 15 * time.Minute
+
+// MaxAttempts is the number of wrong guesses after which a code is locked.
+const MaxAttempts = 5
+
+// codeDigits is the length of the numeric codes sent to users.
+const codeDigits = 6
+
+var (
+	ErrNotFound    = errors.New("no active verification code")
+	ErrExpired     = errors.New("verification code has expired")
+	ErrLocked      = errors.New("too many failed attempts")
+	ErrInvalidCode = errors.New("invalid verification code")
+)
+
+// VerificationStore issues and checks one-time codes for the different verification purposes.
+type VerificationStore struct {
+	db     *gorm.DB
+	secret []byte
+}
+
+// NewVerificationStore creates a VerificationStore. Codes are stored as an HMAC keyed with
+// secret, since a six digit code is trivially brute-forced from a plain hash if the database
+// leaks. The secret must stay the same across restarts, or every active code stops working.
+func NewVerificationStore(db *gorm.DB, secret []byte) *VerificationStore {
+	if db == nil {
+		panic("Got nil database")
+	}
+	if len(secret) == 0 {
+		panic("Got empty verification secret")
+	}
+	return &VerificationStore{db: db, secret: secret}
+}
+
+// Issue creates a new code for the user and purpose, replacing any active one, and returns
+// the plaintext code to send to the user. A non-positive ttl falls back to DefaultTTL.
+func (s *VerificationStore) Issue(userID string, purpose string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	max := big.NewInt(1)
+	for i := 0; i < codeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", codeDigits, n)
+
+	verification := &types.Verification{
+		UserID:    userID,
+		Purpose:   purpose,
+		CodeHash:  s.hashCode(userID, purpose, code),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND purpose = ?", userID, purpose).Delete(&types.Verification{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(verification).Error; err != nil {
+			return err
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_verify_sent", purpose, true)
+	}); err != nil {
+		if logErr := dbutil.LogUserEvent(s.db, userID, "user_verify_set_failure", purpose, false); logErr != nil {
+			return "", logErr
+		}
+		return "", err
+	}
+	return code, nil
+}
+
+// Verify checks a code and consumes it if it matches, so that it can only be used once.
+// Wrong guesses count towards MaxAttempts, after which ErrLocked is returned until a new code
+// is issued.
+func (s *VerificationStore) Verify(userID string, purpose string, code string) error {
+	var result error
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		verification := &types.Verification{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND purpose = ?", userID, purpose).
+			First(verification).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				result = ErrNotFound
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case !time.Now().Before(verification.ExpiresAt):
+			result = ErrExpired
+		case verification.Attempts >= MaxAttempts:
+			result = ErrLocked
+		case subtle.ConstantTimeCompare([]byte(s.hashCode(userID, purpose, code)), []byte(verification.CodeHash)) != 1:
+			result = ErrInvalidCode
+			if err := tx.Model(verification).Update("attempts", gorm.Expr("attempts + 1")).Error; err != nil {
+				return err
+			}
+		default:
+			if err := tx.Delete(verification).Error; err != nil {
+				return err
+			}
+		}
+
+		// The attempt counter has to be committed even when the code was wrong, so failures
+		// are reported through result rather than by rolling back.
+		if result != nil {
+			return dbutil.LogUserEvent(tx, userID, "user_verify_failure", purpose, false)
+		}
+		return dbutil.LogUserEvent(tx, userID, "user_verify_success", purpose, true)
+	}); err != nil {
+		return err
+	}
+	return result
+}
+
+// Cleanup deletes every expired code and returns how many were removed.
+func (s *VerificationStore) Cleanup() (int64, error) {
+	result := s.db.Where("expires_at <= ?", time.Now()).Delete(&types.Verification{})
+	return result.RowsAffected, result.Error
+}
+
+// hashCode binds the code to its user and purpose, so that a hash can't be copied between rows.
+func (s *VerificationStore) hashCode(userID string, purpose string, code string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(userID + ":" + purpose + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// MigrateLegacyVerifications drops the verifications table if it predates purposes. The old
+// codes are short-lived anyway, so users only need to request a new one. It must run before
+// AutoMigrate.
+func MigrateLegacyVerifications(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&types.Verification{}) || migrator.HasColumn(&types.Verification{}, "Purpose") {
+		return nil
+	}
+	return migrator.DropTable(&types.Verification{})
+}
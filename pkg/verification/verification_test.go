@@ -0,0 +1,104 @@
+package verification
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/internal/dbtest"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+func newTestStore(t *testing.T) *VerificationStore {
+	db := dbtest.Open(t, &types.User{}, &types.Verification{}, &types.UserEvent{})
+	return NewVerificationStore(db, []byte("test secret"))
+}
+
+func TestHashCode(t *testing.T) {
+	s := &VerificationStore{secret: []byte("secret")}
+	other := &VerificationStore{secret: []byte("other secret")}
+	hash := s.hashCode("user", PurposeEmailVerify, "123456")
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"other code", s.hashCode("user", PurposeEmailVerify, "123457")},
+		{"other user", s.hashCode("user2", PurposeEmailVerify, "123456")},
+		{"other purpose", s.hashCode("user", PurposePasswordReset, "123456")},
+		{"other secret", other.hashCode("user", PurposeEmailVerify, "123456")},
+	}
+	for _, test := range tests {
+		if test.hash == hash {
+			t.Errorf("%s gives the same hash", test.name)
+		}
+	}
+	if s.hashCode("user", PurposeEmailVerify, "123456") != hash {
+		t.Error("hashCode isn't deterministic")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newTestStore(t)
+	code, err := s.Issue("user", PurposeEmailVerify, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != codeDigits {
+		t.Fatalf("code %q has %d digits, want %d", code, len(code), codeDigits)
+	}
+
+	if err := s.Verify("user", PurposePasswordReset, code); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Verify for another purpose = %v, want ErrNotFound", err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	if err := s.Verify("user", PurposeEmailVerify, wrong); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify with a wrong code = %v, want ErrInvalidCode", err)
+	}
+	if err := s.Verify("user", PurposeEmailVerify, code); err != nil {
+		t.Errorf("Verify with the right code: %v", err)
+	}
+	if err := s.Verify("user", PurposeEmailVerify, code); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Verify with a used code = %v, want ErrNotFound", err)
+	}
+}
+
+func TestVerifyLocksAfterMaxAttempts(t *testing.T) {
+	s := newTestStore(t)
+	code, err := s.Issue("user", PurposeEmailVerify, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	for i := 0; i < MaxAttempts; i++ {
+		if err := s.Verify("user", PurposeEmailVerify, wrong); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d = %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+	if err := s.Verify("user", PurposeEmailVerify, code); !errors.Is(err, ErrLocked) {
+		t.Errorf("Verify after too many attempts = %v, want ErrLocked", err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	s := newTestStore(t)
+	code, err := s.Issue("user", PurposeEmailVerify, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(&types.Verification{}).Where("user_id = ?", "user").Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify("user", PurposeEmailVerify, code); !errors.Is(err, ErrExpired) {
+		t.Errorf("Verify with an expired code = %v, want ErrExpired", err)
+	}
+	if count, err := s.Cleanup(); err != nil || count != 1 {
+		t.Errorf("Cleanup = %d, %v, want 1", count, err)
+	}
+}